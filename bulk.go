@@ -0,0 +1,83 @@
+package epay
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NewPaymentRequestsFromReader creates prepared payment requests from CSV data read from r, e.g. for bulk invoicing
+// Every row consists of the amount, description and invoice number, an optional header row starting with "amount" is
+// skipped. The options are applied to all payment requests. Malformed rows are reported by the line they start at, in
+// which case no payment requests are returned.
+func (api *API) NewPaymentRequestsFromReader(r io.Reader, opts ...PaymentOption) ([]*PaymentRequest, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	var (
+		requests []*PaymentRequest
+		errs     []error
+	)
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Rows with the wrong number of fields can be skipped, other errors mean the data can't be read any further
+			var perr *csv.ParseError
+			if errors.As(err, &perr) && errors.Is(perr.Err, csv.ErrFieldCount) {
+				errs = append(errs, fmt.Errorf("line %d: expected 3 fields, but got %d", perr.StartLine, len(record)))
+				continue
+			}
+			errs = append(errs, err)
+			break
+		}
+
+		// Skip the header
+		if first && strings.EqualFold(strings.TrimSpace(record[0]), "amount") {
+			continue
+		}
+
+		// Blank lines are skipped and quoted fields can span lines, so the line is taken from the reader
+		line, _ := cr.FieldPos(0)
+		p, err := api.paymentRequestFromRecord(record, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		requests = append(requests, p)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return requests, nil
+}
+
+// paymentRequestFromRecord creates a prepared payment request from a CSV record of the amount, description and invoice number
+func (api *API) paymentRequestFromRecord(record []string, opts ...PaymentOption) (*PaymentRequest, error) {
+	amount, err := strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount %q", record[0])
+	}
+
+	invoice, err := strconv.ParseUint(strings.TrimSpace(record[2]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice %q", record[2])
+	}
+
+	p, err := api.NewPaymentRequest(amount, record[1], invoice, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.Prepare(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
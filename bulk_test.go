@@ -0,0 +1,69 @@
+package epay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPaymentRequestsFromReader(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	data := "amount,description,invoice\n10.50,Subscription,1\n20,\"Order, two items\",2\n"
+	requests, err := api.NewPaymentRequestsFromReader(strings.NewReader(data), WithCurrency(BGN))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := 2; len(requests) != expected {
+		t.Fatalf("expected %d payment requests, but got %d", expected, len(requests))
+	}
+
+	p := requests[1]
+	if p.Amount != 20 || p.Description != "Order, two items" || p.Invoice != 2 || p.Currency != BGN {
+		t.Fatalf("expected the values of the second row, but got %+v", p)
+	}
+
+	for _, p := range requests {
+		if p.Encoded() == "" || p.Checksum() == "" {
+			t.Fatalf("expected payment request %d to be prepared", p.Invoice)
+		}
+	}
+
+	// Malformed rows are reported with the line they start at, which differs from the row after blank lines and
+	// multi-line fields
+	data = "10,first,1\n\nten,second,2\n30,third\n20,\"fifth\nrow\",3\n40,fourth,x\n"
+	requests, err = api.NewPaymentRequestsFromReader(strings.NewReader(data))
+	if err == nil {
+		t.Fatal("expected to fail, but got no error")
+	}
+
+	if requests != nil {
+		t.Fatalf("expected no payment requests, but got %d", len(requests))
+	}
+
+	for _, expected := range []string{"line 3: invalid amount", "line 4: expected 3 fields", "line 5: encoding error", "line 7: invalid invoice"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error to contain %q, but got %q", expected, err.Error())
+		}
+	}
+
+	if strings.Contains(err.Error(), "line 1:") {
+		t.Fatalf("expected the first row to be valid, but got %q", err.Error())
+	}
+}
+
+func TestNewPaymentRequestsFromReaderMultiLineDescription(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// A quoted CSV field can span lines, which mustn't end up in the encoded data
+	data := "10,\"Order 42\nINVOICE=43\",1\n"
+	if _, err := api.NewPaymentRequestsFromReader(strings.NewReader(data)); err == nil || !strings.Contains(err.Error(), "line breaks") {
+		t.Fatalf("expected the description to be rejected, but got %v", err)
+	}
+}
@@ -1,37 +1,150 @@
 package epay
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"embed"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/encoding/charmap"
 )
 
 const (
 	ePayURL     = "https://www.epay.bg/"
 	ePayDemoURL = "https://demo.epay.bg/"
+
+	// maxEncodedLength is the maximum length of the encoded payment data accepted by ePay
+	maxEncodedLength = 4096
+
+	// merchantNameField is the field of the encoded data which overrides the displayed merchant name
+	merchantNameField = "MERCHANT_NAME"
+
+	// logoField is the field of the encoded data which contains the URL of the logo displayed on the ePay page
+	logoField = "LOGO"
+
+	// themeField is the field of the encoded data which selects the theme of the ePay page
+	themeField = "THEME"
+
+	// maxInvoiceDigits is the maximum number of digits of an invoice number accepted by ePay
+	maxInvoiceDigits = 10
+
+	// maxInvoice is the largest invoice number with maxInvoiceDigits digits
+	maxInvoice = 9999999999
+
+	// maxMerchantNameLength is the maximum length of the merchant name
+	maxMerchantNameLength = 64
+
+	// defaultMaxExpirationWindow is the default of how far in the future the expiration time of a payment request can be
+	defaultMaxExpirationWindow = 30 * 24 * time.Hour
+
+	// defaultAnswerContentType is the content type of the answer to ePay's callbacks
+	defaultAnswerContentType = "text/plain; charset=utf-8"
 )
 
+// sofia is the time zone of ePay, in which the expiration time is sent and the pay time is received
+// Without the time zone database it falls back to EET (UTC+2), which is an hour off during daylight saving time.
+// Importing time/tzdata in the application embeds the database and avoids the fallback.
+var sofia = loadSofia()
+
+// loadSofia loads the Europe/Sofia time zone, or returns the fixed EET zone if it isn't available
+func loadSofia() *time.Location {
+	loc, err := time.LoadLocation("Europe/Sofia")
+	if err != nil {
+		return time.FixedZone("EET", 2*60*60)
+	}
+	return loc
+}
+
+//go:embed templates/simplepaymentrequest.html
+var templates embed.FS
+
+// defaultFormTemplate is the template of the payment form rendered by PaymentRequestHandler, unless WithFormTemplate is used
+var defaultFormTemplate = template.Must(template.ParseFS(templates, "templates/simplepaymentrequest.html"))
+
+// formTemplate is the template of the form rendered by GenerateForm
+var formTemplate = template.Must(template.New("form").Parse(`<form action="{{ .Action }}" method="{{ .Method }}">
+{{ range $name, $values := .Fields }}<input type="hidden" name="{{ $name }}" value="{{ index $values 0 }}">
+{{ end }}<input type="submit" value="{{ .Submit }}">
+</form>`))
+
+// buttonTemplate is the template of the button rendered by ButtonHTML
+var buttonTemplate = template.Must(template.New("button").Parse(`<form action="{{ .Action }}" method="{{ .Method }}" style="display:inline">
+{{ range $name, $values := .Fields }}<input type="hidden" name="{{ $name }}" value="{{ index $values 0 }}">
+{{ end }}<button type="submit" style="background:#1a4c8b;color:#fff;border:0;border-radius:4px;padding:10px 20px;font-size:16px;cursor:pointer">{{ .Submit }}</button>
+</form>`))
+
 // PaymentRequest represents a payment request for a client
 type PaymentRequest struct {
 	mu sync.RWMutex
 	// page, url, cin, encoded and checksum are private, because the user shouldn't change these values. The values are to be set
 	// via the NewPaymentRequest function of the API to ensure a proper request is created.
 	page     string
+	method   string
 	url      string
 	cin      string
 	encoded  string
 	checksum string
 
+	// fields contains the optional fields which are set by options, e.g. for customization of the ePay page
+	fields []field
+
+	// charset is the character set the encoded data is transcoded to, empty means the data is left as is
+	charset string
+
+	// hooks are the validation hooks which are run before encoding
+	hooks []func(*PaymentRequest) error
+
+	// clock returns the current time, it's inherited from the API
+	clock func() time.Time
+
+	// strict is true when the API is in strict mode
+	strict bool
+
+	// noDescription is true when the payment request intentionally has no description
+	noDescription bool
+
+	// noPageCurrencyCheck is true when the currency isn't checked against the currencies supported by the page
+	noPageCurrencyCheck bool
+
+	// maxExpirationWindow is how far in the future the expiration time can be, zero means defaultMaxExpirationWindow
+	maxExpirationWindow time.Duration
+
+	// maxClockSkew is how long the payment request is still accepted after its expiration time, it's inherited from the API
+	maxClockSkew time.Duration
+
+	// newline separates the fields of the encoded data, empty means "\n" as documented by ePay
+	newline string
+
+	// errorLanguage is the language of the messages of validation errors, it's inherited from the API
+	errorLanguage Language
+
+	// formTemplate is the template of the payment page, it's inherited from the API and nil means defaultFormTemplate
+	formTemplate *template.Template
+
+	// amountCents is the exact amount set via WithAmountCents, exactAmount is true if it's set
+	amountCents uint64
+	exactAmount bool
+
 	// Currency is the currency used for this payment request
 	Currency Currency // BGN, EUR or USD
 
@@ -57,81 +170,268 @@ type PaymentRequest struct {
 	Language Language // en or bg
 }
 
-// encode validates all required fields and then sets the value of encoded
-func (p *PaymentRequest) encode() error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	str := ""
+// Validate checks all fields of the payment request, including the validation hooks, and reports every problem at once
+// The returned error combines the errors of all invalid fields, which can be matched with errors.Is against ErrEmptyCIN,
+// ErrInvalidInvoice, ErrInvalidAmount and ErrInvalidExpiration.
+func (p *PaymentRequest) Validate() error {
+	var errs []error
+
+	// Run the validation hooks before anything else
+	for _, hook := range p.hooks {
+		if err := hook(p); err != nil {
+			errs = append(errs, fmt.Errorf("validation hook: %w", err))
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-	// Check is there is a invalid client identification number, if so return an error
+	// Check is there is a invalid client identification number
 	if p.cin == "" {
-		return fmt.Errorf("CIN is empty")
+		errs = append(errs, p.errorf("%w", ErrEmptyCIN))
 	}
-	str += fmt.Sprintf("MIN=%s\n", p.cin)
 
-	// Check if there is an invalid invoice number, if so return an error
+	// Check if there is an invalid invoice number
 	if p.Invoice <= 0 {
-		return fmt.Errorf("Invoice is invalid")
+		errs = append(errs, p.errorf("%w", ErrInvalidInvoice))
+	} else if p.Invoice > maxInvoice {
+		errs = append(errs, p.errorf("%w, must have at most %d digits", ErrInvalidInvoice, maxInvoiceDigits))
 	}
-	str += fmt.Sprintf("INVOICE=%d\n", p.Invoice)
 
-	// Check if there is an invalid amount, if so return an error
-	if p.Amount < 0.01 {
-		return fmt.Errorf("Amount is invalid")
+	// Check if there is an invalid amount for the currency
+	// ePay uses BGN when no currency is provided
+	curr := p.Currency
+	if curr == "" {
+		curr = BGN
+	}
+	if limit, ok := amountLimits[curr]; !ok {
+		errs = append(errs, p.errorf("Currency %q is invalid", p.Currency))
+	} else if p.Amount < limit.min || p.Amount > limit.max {
+		errs = append(errs, p.errorf("%w, must be between %.2f and %.2f %s", ErrInvalidAmount, limit.min, limit.max, curr))
+	}
+
+	// Check if the page supports the currency, the customer can't complete the payment otherwise
+	if _, ok := amountLimits[curr]; ok && !p.noPageCurrencyCheck && !pageSupportsCurrency(PaymentPage(p.page), curr) {
+		errs = append(errs, p.errorf("%w, %s is not supported by page %s", ErrUnsupportedCurrency, curr, p.page))
 	}
-	str += fmt.Sprintf("AMOUNT=%.2f\n", p.Amount)
 
-	// Check if there is an invalid expiration time, if so return an error
+	// Check if there is an invalid expiration time
+	window := p.maxExpirationWindow
+	if window == 0 {
+		window = defaultMaxExpirationWindow
+	}
 	if p.ExpirationTime.IsZero() {
-		return fmt.Errorf("Expiration time is invalid")
+		errs = append(errs, p.errorf("%w", ErrInvalidExpiration))
+	} else if p.Expired() {
+		errs = append(errs, p.errorf("%w, has already passed", ErrInvalidExpiration))
+	} else if p.ExpirationTime.After(p.now().Add(window)) {
+		errs = append(errs, p.errorf("%w, must be within %v from now", ErrInvalidExpiration, window))
 	}
-	str += fmt.Sprintf("EXP_TIME=%s\n", p.ExpirationTime.Format("02.01.2006 15:04:05"))
 
-	// Currency is optional
-	if p.Currency != "" {
-		str += fmt.Sprintf("CURRENCY=%s\n", p.Currency)
+	// Description is optional, but in strict mode it has to be waived explicitly via WithNoDescription
+	if p.strict && p.Description == "" && !p.noDescription {
+		errs = append(errs, p.errorf("Description is empty"))
+	}
+	// Registered ePay users see the description in their list of payments, so it's required for the login page
+	if p.page == string(Login) && p.Description == "" {
+		errs = append(errs, p.errorf("Description is required for page %s", Login))
+	}
+	// Every field is a line of the encoded data, a line break would inject fields into the signed data
+	if strings.ContainsAny(p.Description, "\r\n") {
+		errs = append(errs, p.errorf("Description must not contain line breaks"))
 	}
 
-	// Language is optional
-	if p.Language != "" {
-		str += fmt.Sprintf("LANGUAGE=%s\n", p.Language)
+	return errors.Join(errs...)
+}
+
+// encode validates all fields and then sets the value of encoded
+func (p *PaymentRequest) encode() error {
+	if err := p.Validate(); err != nil {
+		return err
 	}
 
-	// Description is optional
-	if p.Description != "" {
-		str += fmt.Sprintf("LANGUAGE=%s\n", p.Description)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	encoded, err := p.encodeData()
+	if err != nil {
+		return err
 	}
 
-	// Encode everything
-	p.encoded = base64.StdEncoding.EncodeToString([]byte(str))
+	// Check if the encoded data doesn't exceed the maximum length, if so return an error
+	if len(encoded) > maxEncodedLength {
+		return fmt.Errorf("Encoded data is too long: %d exceeds the maximum of %d characters", len(encoded), maxEncodedLength)
+	}
+
+	p.encoded = encoded
 	return nil
 }
 
-// CalcChecksum calculates and sets the hmac/sha1 checksum over the encoded data of the payment
-func (p *PaymentRequest) CalcChecksum(secret string) error {
-	// Encode data in case there isn't any encoded data yet
-	if p.encoded == "" {
-		if err := p.encode(); err != nil {
-			return fmt.Errorf("encoding error: %v", err)
+// EncodedLength returns the length of the encoded data of the payment request in its current state
+// Nothing is validated or stored, so it can be used to warn about the maximum length while the fields are being filled in
+func (p *PaymentRequest) EncodedLength() (int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	encoded, err := p.encodeData()
+	if err != nil {
+		return 0, err
+	}
+	return len(encoded), nil
+}
+
+// encodeData returns the fields of the payment request as base64 encoded data, the caller has to hold the lock
+func (p *PaymentRequest) encodeData() (string, error) {
+	// Every field is written on a line of its own
+	nl := p.newline
+	if nl == "" {
+		nl = "\n"
+	}
+	str := ""
+	line := func(format string, a ...any) {
+		str += fmt.Sprintf(format, a...) + nl
+	}
+
+	values := map[string]string{
+		"MIN":        p.cin,
+		"INVOICE":    strconv.FormatUint(p.Invoice, 10),
+		"AMOUNT":     formatCents(p.cents()),
+		"EXP_TIME":   p.ExpirationTime.In(sofia).Format("02.01.2006 15:04:05"),
+		"CURRENCY":   string(p.Currency),
+		"LANGUAGE":   string(p.Language),
+		"DESCR":      p.Description,
+		"URL_OK":     p.URLOk,
+		"URL_CANCEL": p.URLCancel,
+	}
+	if p.charset == "utf-8" {
+		values["ENCODING"] = p.charset
+	}
+
+	// The fields set by options are written as optional fields
+	for _, f := range p.fields {
+		values[f.name] = f.value
+	}
+
+	// The required fields are always written, the optional fields only if they're set
+	for _, name := range requiredFields {
+		line("%s=%s", name, values[name])
+	}
+	for _, name := range optionalFields {
+		if v := values[name]; v != "" {
+			line("%s=%s", name, v)
+		}
+	}
+
+	// Transcode the data to the requested character set
+	data := []byte(str)
+	if p.charset == "cp1251" {
+		b, err := charmap.Windows1251.NewEncoder().Bytes(data)
+		if err != nil {
+			return "", fmt.Errorf("Data can't be encoded as cp1251: %v", err)
 		}
+		data = b
+	}
+
+	// Encode everything
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// CalcChecksum encodes the payment and calculates and sets the hmac/sha1 checksum over the encoded data
+// The data is encoded again on every call, so the checksum always reflects the current fields, even if they were
+// changed directly after an earlier call
+func (p *PaymentRequest) CalcChecksum(secret string) error {
+	if err := p.encode(); err != nil {
+		return fmt.Errorf("encoding error: %v", err)
 	}
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	// Create a checksum with hmac
-	h := hmac.New(sha1.New, []byte(secret))
-	h.Write([]byte(p.encoded))
-	p.checksum = hex.EncodeToString(h.Sum(nil))
+	p.checksum = Checksum(secret, p.encoded)
 
 	return nil
 }
 
+// Checksum returns the hex encoded hmac/sha1 checksum of the encoded data with secret as key
+// It's the checksum ePay expects for payment requests and sends along with callbacks, and doesn't require an API
+func Checksum(secret, encoded string) string {
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(encoded))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyChecksum checks in constant time if checksum is the checksum of the encoded data with secret as key
+// The raw bytes of the checksums are compared, so the case of the hex encoded checksum doesn't matter. Verification always
+// fails if the secret is empty.
+func VerifyChecksum(secret, encoded, checksum string) bool {
+	if secret == "" {
+		return false
+	}
+
+	sig, err := hex.DecodeString(strings.ToLower(strings.TrimSpace(checksum)))
+	if err != nil {
+		return false
+	}
+
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(encoded))
+	return hmac.Equal(h.Sum(nil), sig)
+}
+
 // API provides functionality to communicate with ePay
 type API struct {
-	url             string
-	cin             string
-	secret          string
-	defaultLanguage Language
+	mu                  sync.RWMutex
+	url                 string
+	cin                 string
+	secret              Secret
+	defaultLanguage     Language
+	defaultCurrency     Currency
+	urlOk               string
+	urlCancel           string
+	validateOnly        bool
+	handlers            []PaymentHandlerFunc
+	clock               func() time.Time
+	strict              bool
+	metrics             Metrics
+	demoCIN             string
+	client              *http.Client
+	answerContentType   string
+	debug               bool
+	expiredHandler      http.Handler
+	strictCallbacks     bool
+	rawCallbackObserver func(encoded, decoded, checksum string)
+	cinInAnswer         bool
+	maxExpirationWindow time.Duration
+	maxClockSkew        time.Duration
+	keys                map[string]Secret
+	keyID               string
+	pingTTL             time.Duration
+	ping                pingCache
+	formTemplate        *template.Template
+	responseBuilder     func(results []CallbackResult) (int, []byte)
+	replay              *replayCache
+	mapper              TransactionMapper
+	logger              Logger
+	errorLanguage       Language
+	defaultDescription  string
+	transitionValidator func(invoice uint64, newStatus PaymentStatus) error
+	invoiceGenerator    func() uint64
+	consistencyLookup   func(ctx context.Context, invoice uint64) (float64, Currency, error)
+	maxCallbackAge      time.Duration
+	maxBatchSize        int
+}
+
+// Logger is the destination of the diagnostic messages of the API, which is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// now returns the current time according to the clock of the API
+func (api *API) now() time.Time {
+	if api.clock == nil {
+		return time.Now()
+	}
+	return api.clock()
 }
 
 // PaymentOption is a custom function type used for setting optional fields of PaymentRequest
@@ -159,20 +459,13 @@ func (l Language) String() string {
 
 // LanguageFromString converts a string to it's corresponding language
 func LanguageFromString(l string) (Language, error) {
-	lang := strings.Trim(strings.ToLower(l), " ")
-	switch lang {
-	case "english"
-	case "eng":
-	case "en":
+	switch strings.ToLower(strings.TrimSpace(l)) {
+	case "english", "eng", "en":
 		return English, nil
-	case "български":
-	case "бг":
-	case "bulgarian":
-	case "bul":
-	case "bg":
+	case "български", "бг", "bulgarian", "bul", "bg":
 		return Bulgarian, nil
 	default:
-		return Language(""), fmt.Errorf("unsupported language")
+		return Language(""), fmt.Errorf("unsupported language %q", l)
 	}
 }
 
@@ -201,18 +494,69 @@ func (p Currency) String() string {
 
 // CurrencyFromString converts a string to it's corresponding currency
 func CurrencyFromString(c string) (Currency, error) {
-	curr := strings.Trim(strings.ToLower(c), " ")
-	switch(curr) {
-	case "euro":
-	case "eur":
+	switch strings.ToLower(strings.TrimSpace(c)) {
+	case "euro", "eur":
 		return EUR, nil
-	case "bgn":
+	case "lev", "лев", "bgn":
 		return BGN, nil
 	case "usd":
 		return USD, nil
 	default:
-		return Currency(""), fmt.Errorf("unsupported currrency")
+		return Currency(""), fmt.Errorf("unsupported currency %q", c)
+	}
+}
+
+// currencyCodes maps the ISO 4217 numeric codes to their currency
+var currencyCodes = map[uint64]Currency{
+	975: BGN,
+	978: EUR,
+	840: USD,
+}
+
+// ParseCurrency converts an alpha code like "EUR", a numeric code like 978 or a numeric string like "978" to it's currency
+func ParseCurrency(v any) (Currency, error) {
+	var code uint64
+	switch c := v.(type) {
+	case Currency:
+		return CurrencyFromString(string(c))
+	case string:
+		n, err := strconv.ParseUint(strings.TrimSpace(c), 10, 16)
+		if err != nil {
+			return CurrencyFromString(c)
+		}
+		code = n
+	case int:
+		if c < 0 {
+			return Currency(""), fmt.Errorf("invalid currency code %d", c)
+		}
+		code = uint64(c)
+	case int32:
+		if c < 0 {
+			return Currency(""), fmt.Errorf("invalid currency code %d", c)
+		}
+		code = uint64(c)
+	case int64:
+		if c < 0 {
+			return Currency(""), fmt.Errorf("invalid currency code %d", c)
+		}
+		code = uint64(c)
+	case uint:
+		code = uint64(c)
+	case uint16:
+		code = uint64(c)
+	case uint32:
+		code = uint64(c)
+	case uint64:
+		code = c
+	default:
+		return Currency(""), fmt.Errorf("unsupported currency type %T", v)
 	}
+
+	curr, ok := currencyCodes[code]
+	if !ok {
+		return Currency(""), fmt.Errorf("unsupported currency code %d", code)
+	}
+	return curr, nil
 }
 
 var (
@@ -224,6 +568,19 @@ var (
 	USD Currency = "USD"
 )
 
+// amountLimit is the minimum and maximum amount of a payment request
+type amountLimit struct {
+	min float64
+	max float64
+}
+
+// amountLimits contains the amount limits per currency
+var amountLimits = map[Currency]amountLimit{
+	BGN: {min: 0.01, max: 100000},
+	EUR: {min: 0.01, max: 50000},
+	USD: {min: 0.01, max: 50000},
+}
+
 // WithCurrency overrides the default currency of a PaymentRequest
 func WithCurrency(c Currency) PaymentOption {
 	return func(p *PaymentRequest) error {
@@ -242,6 +599,28 @@ var (
 	Direct PaymentPage = "credit_paydirect"
 )
 
+// pageCurrencies contains the currencies which can be paid on each page
+// Registered ePay users only have BGN and EUR accounts, so paylogin doesn't settle in any other currency. Cards are
+// charged in all currencies supported by ePay on credit_paydirect. Pages which aren't listed aren't checked.
+var pageCurrencies = map[PaymentPage][]Currency{
+	Login:  {BGN, EUR},
+	Direct: {BGN, EUR, USD},
+}
+
+// pageSupportsCurrency returns true if c can be paid on page pg
+func pageSupportsCurrency(pg PaymentPage, c Currency) bool {
+	currencies, ok := pageCurrencies[pg]
+	if !ok {
+		return true
+	}
+	for _, curr := range currencies {
+		if curr == c {
+			return true
+		}
+	}
+	return false
+}
+
 // WithPage overrides the default page type of a PaymentRequest
 func WithPage(pg PaymentPage) PaymentOption {
 	return func(p *PaymentRequest) error {
@@ -250,321 +629,1945 @@ func WithPage(pg PaymentPage) PaymentOption {
 	}
 }
 
-// NewPaymentRequest creates and prepares a new payment request
-// Mandatory fields are provided as static arguments, optional fields as options
-// By default the currency is EUR, expiration time is 7 days, language is English
-func (api *API) NewPaymentRequest(amount float64, description string, invoice uint64, options ...PaymentOption) (*PaymentRequest, error) {
-	// Create a new payment request
-	p := PaymentRequest{
-		page:           "credit_paydirect",
-		cin:            api.cin,
-		url:            api.url,
-		ExpirationTime: time.Now().AddDate(0, 0, 7),
-		Language:       English,
-		Currency:       EUR,
-		Amount:         amount,
-		Description:    description,
-		Invoice:        invoice,
+// WithoutPageCurrencyCheck disables the check whether the page supports the currency of a PaymentRequest
+// It's meant for currencies which ePay starts to support on a page before this package knows about it
+func WithoutPageCurrencyCheck() PaymentOption {
+	return func(p *PaymentRequest) error {
+		p.noPageCurrencyCheck = true
+		return nil
 	}
+}
 
-	// Loop over the options
-	for _, option := range options {
-		if err := option(&p); err != nil {
-			return nil, err
-		}
+// WithNoDescription marks a payment request as intentionally having no description
+// This distinguishes "intentionally none" from "forgot to set" in strict mode
+func WithNoDescription() PaymentOption {
+	return func(p *PaymentRequest) error {
+		p.Description = ""
+		p.noDescription = true
+		return nil
 	}
-
-	return &p, nil
 }
 
-// URL gets the url for execution of the payment request
-// This function is mainly meant to be used in a template
-func (p *PaymentRequest) URL() string {
-	return p.url
+// WithNormalizedDescription collapses all whitespace in the description to single spaces and trims it
+// Descriptions pasted from user interfaces often contain whitespace which is displayed awkwardly by ePay
+func WithNormalizedDescription() PaymentOption {
+	return func(p *PaymentRequest) error {
+		p.Description = strings.Join(strings.Fields(p.Description), " ")
+		return nil
+	}
 }
 
-// Page gets the page type for the payment request
-// This function is mainly meant to be used in a template
-func (p *PaymentRequest) Page() string {
-	return p.page
+// WithValidationHook adds a hook which is run before the payment request is encoded
+// It's meant for cross-field business rules, e.g. a maximum amount for a certain currency. Returning an error prevents encoding.
+func WithValidationHook(hook func(*PaymentRequest) error) PaymentOption {
+	return func(p *PaymentRequest) error {
+		if hook == nil {
+			return fmt.Errorf("validation hook is nil")
+		}
+
+		p.hooks = append(p.hooks, hook)
+		return nil
+	}
 }
 
-// CIN gets the Client Indentification Number
-// This function is mainly meant to be used in a template
-func (p *PaymentRequest) CIN() string {
-	return p.cin
+// WithCharset sets the character set in which the data is sent to ePay
+// Supported are "cp1251", which transcodes the data for ePay's legacy endpoints, and "utf-8", which tells ePay that the data is UTF-8
+func WithCharset(charset string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		switch cs := strings.ToLower(strings.TrimSpace(charset)); cs {
+		case "cp1251", "windows-1251":
+			p.charset = "cp1251"
+		case "utf-8", "utf8":
+			p.charset = "utf-8"
+		default:
+			return fmt.Errorf("unsupported charset %q", charset)
+		}
+		return nil
+	}
 }
 
-// Encoded gets the encoded payment request
-// This function is mainly meant to be used in a template
-func (p *PaymentRequest) Encoded() string {
-	return p.encoded
+// field is an additional name/value pair of the encoded data of a PaymentRequest
+type field struct {
+	name  string
+	value string
 }
 
-// Checksum gets the checksum of the payment request
-// This function is mainly meant to be used in a template
-func (p *PaymentRequest) Checksum() string {
-	return p.checksum
+// requiredFields are the fields which are always part of the encoded data, in the order they're encoded
+var requiredFields = []string{"MIN", "INVOICE", "AMOUNT", "EXP_TIME"}
+
+// optionalFields are the fields which are only part of the encoded data if they're set, in the order they're encoded
+var optionalFields = []string{"CURRENCY", "LANGUAGE", "DESCR", "URL_OK", "URL_CANCEL", merchantNameField, logoField, themeField, keyIDField, "ENCODING"}
+
+// RequiredFields returns the names of the fields which are always part of the encoded data of a payment request
+func RequiredFields() []string {
+	return append([]string(nil), requiredFields...)
 }
 
-// PaymentRequestHandler is a HandlerFunc for processing payment requests
-// Expects to get the following data are POST or GET arguments:
-// amount: The sum requested from the client (mandatory)
-// description: A description what the payment is for (mandatory)
-// invoice: The invoice number (mandatory)
-// language: The language of epay's user interface (optional) [en*, bg]
-// currency: The currency (optional) [eur*, bgn, usd]
-// type: The type of payment (optional) [direct*, login]
-func (api *API) PaymentRequestHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+// OptionalFields returns the names of the fields which are part of the encoded data of a payment request if they're set
+func OptionalFields() []string {
+	return append([]string(nil), optionalFields...)
+}
 
-	// Get the mandatory amount
-	amount, err := strconv.ParseFloat(r.FormValue("amount"), 64)
-	if err != nil {
-		http.Error(w, "amount is invalid or missing", http.StatusInternalServerError)
-		return
+// setField sets the optional field name to value
+func (p *PaymentRequest) setField(name, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value for field %q", name)
 	}
 
-	// Get the mandatory description
-	description := r.FormValue("description")
-	if description == "" {
-		http.Error(w, "description is empty", http.StatusInternalServerError)
-		return
+	for i, f := range p.fields {
+		if f.name == name {
+			p.fields[i].value = value
+			return nil
+		}
 	}
 
-	// Get the mandatory invoice number
-	invoice, err := strconv.ParseUint(r.FormValue("invoice"), 10, 64)
-	if err != nil {
-		http.Error(w, "invoice is invalid or missing", http.StatusInternalServerError)
-		return
+	p.fields = append(p.fields, field{name: name, value: value})
+	return nil
+}
+
+// WithNewline overrides the separator of the fields in the encoded data, which can be "\n" or "\r\n"
+// ePay documents "\n", which is the default. "\r\n" is only meant for environments which require it.
+func WithNewline(nl string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		if nl != "\n" && nl != "\r\n" {
+			return fmt.Errorf("unsupported newline %q", nl)
+		}
+
+		p.newline = nl
+		return nil
 	}
+}
 
-	// Create an empty slice of payment options to collect the options to be executed based upon the optional parameters
-	options := []PaymentOption{}
+// WithMerchantName overrides the merchant name displayed by ePay for this payment request
+// The name can't be longer than maxMerchantNameLength characters
+func WithMerchantName(name string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("merchant name is empty")
+		}
+
+		if n := utf8.RuneCountInString(name); n > maxMerchantNameLength {
+			return fmt.Errorf("merchant name is too long: %d exceeds the maximum of %d characters", n, maxMerchantNameLength)
+		}
 
-	// Get the optional language
-	l := r.FormValue("language")
-	if l == "" {
-		l = "en"
+		return p.setField(merchantNameField, name)
 	}
-	
-	lang, err := LanguageFromString(l)
-	if err != nil {
-		http.Error(w, "invalid language", http.StatusInternalServerError)
-		return
+}
+
+// Theme is a theme of the ePay pages
+type Theme string
+
+var (
+	// LightTheme is the light theme of the ePay pages, which is the default
+	LightTheme Theme = "light"
+	// DarkTheme is the dark theme of the ePay pages
+	DarkTheme Theme = "dark"
+)
+
+// WithLogoURL sets the logo displayed on the ePay page for this payment request
+// The logo has to be served via https, browsers wouldn't display it on the ePay page otherwise
+func WithLogoURL(logoURL string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		v, err := validateURL(logoURL)
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(v, "https://") {
+			return fmt.Errorf("invalid logo URL %q: scheme must be https", logoURL)
+		}
+
+		return p.setField(logoField, v)
 	}
-	append(options, WithLanguage(lang))
+}
 
+// WithTheme sets the theme of the ePay page for this payment request
+func WithTheme(theme Theme) PaymentOption {
+	return func(p *PaymentRequest) error {
+		if theme != LightTheme && theme != DarkTheme {
+			return fmt.Errorf("unsupported theme %q", theme)
+		}
 
-	// Get the optional currency
-	c := r.FormValue("currency")
-	if c == "" {
-		c = "eur"
+		return p.setField(themeField, string(theme))
 	}
+}
 
-	curr, err := CurrencyFromString(c)
+// validateURL checks if raw is an absolute http or https URL and returns it in its normalized form
+// Internationalized domain names are converted to punycode, so they can be handled by ePay
+func validateURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		http.Error(w, "invalid currency", http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("invalid URL %q: %v", raw, err)
 	}
-	options = append(options, WithCurrency(curr))
 
-	// Get the optional type
-	switch strings.ToLower(r.FormValue("type")) {
-	// Default type is direct payment (credit / debit card)
-	case "":
-	case "direct":
-		options = append(options, WithPage(Direct))
-	// Payment Request for registered ePay users
-	case "request":
-		options = append(options, WithPage(Login))
-	// Invalid type
-	default:
-		http.Error(w, "invalid type", http.StatusInternalServerError)
-		return
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid URL %q: scheme must be http or https", raw)
 	}
 
-	// Create a new payment request
-	data, err := api.NewPaymentRequest(amount, description, invoice, options...)
-
-	// Calculate the checksum
-	data.CalcChecksum(api.secret)
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid URL %q: host is missing", raw)
+	}
 
-	// Open the template for payment processing
-	tpl, err := template.ParseFiles("templates/simplepaymentrequest.html")
+	host, err := idna.Lookup.ToASCII(u.Hostname())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("invalid URL %q: %v", raw, err)
 	}
 
-	// Execute the template
-	if err := tpl.Execute(w, data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
 	}
-}
+	u.Host = host
 
-// PaymentStatus is a custom type to ensure a proper status
-type PaymentStatus string
-
-// String implements the Stringer interface
-func (p PaymentStatus) String() string {
-	return string(p)
+	return u.String(), nil
 }
 
-var (
-	// Paid means a completed payment
+// WithURLOk sets the URL the client will be redirected to after payment, which overrides the default of the API
+func WithURLOk(u string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		v, err := validateURL(u)
+		if err != nil {
+			return err
+		}
+
+		p.URLOk = v
+		return nil
+	}
+}
+
+// WithURLCancel sets the URL the client will be redirected to after cancelling payment, which overrides the default of the API
+func WithURLCancel(u string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		v, err := validateURL(u)
+		if err != nil {
+			return err
+		}
+
+		p.URLCancel = v
+		return nil
+	}
+}
+
+// WithURLOkParams merges params into the query of URLOk, e.g. to carry the order ID back on the return URL
+// Existing parameters of URLOk are preserved, unless they're overridden by params. URLOk has to be set before this option is applied.
+func WithURLOkParams(params url.Values) PaymentOption {
+	return func(p *PaymentRequest) error {
+		if p.URLOk == "" {
+			return fmt.Errorf("URLOk is empty")
+		}
+
+		u, err := url.Parse(p.URLOk)
+		if err != nil {
+			return fmt.Errorf("invalid URLOk: %v", err)
+		}
+
+		q := u.Query()
+		for name, values := range params {
+			q[name] = values
+		}
+		u.RawQuery = q.Encode()
+
+		p.URLOk = u.String()
+		return nil
+	}
+}
+
+// WithFormMethod sets the HTTP method used to submit the payment form to ePay, which can be GET or POST (default)
+func WithFormMethod(method string) PaymentOption {
+	return func(p *PaymentRequest) error {
+		switch m := strings.ToUpper(method); m {
+		case http.MethodGet, http.MethodPost:
+			p.method = m
+		default:
+			return fmt.Errorf("unsupported form method %q", method)
+		}
+		return nil
+	}
+}
+
+// NewPaymentRequest creates and prepares a new payment request
+// Mandatory fields are provided as static arguments, optional fields as options
+// By default the currency is EUR, expiration time is 7 days, language is English, unless the API has other defaults
+// With an invoice generator set via WithInvoiceGenerator an invoice of 0 is replaced by a generated invoice number
+func (api *API) NewPaymentRequest(amount float64, description string, invoice uint64, options ...PaymentOption) (*PaymentRequest, error) {
+	api.mu.RLock()
+	urlOk, urlCancel := api.urlOk, api.urlCancel
+	api.mu.RUnlock()
+
+	// Fall back to the defaults of the API
+	lang, curr := English, EUR
+	if api.defaultLanguage != "" {
+		lang = api.defaultLanguage
+	}
+	if api.defaultCurrency != "" {
+		curr = api.defaultCurrency
+	}
+	if description == "" {
+		description = api.defaultDescription
+	}
+
+	// Assign an invoice number if none is supplied
+	if invoice == 0 && api.invoiceGenerator != nil {
+		invoice = api.invoiceGenerator()
+		if invoice == 0 || invoice > maxInvoice {
+			return nil, fmt.Errorf("invoice generator returned the invalid invoice %d", invoice)
+		}
+	}
+
+	// Create a new payment request
+	p := PaymentRequest{
+		page:                "credit_paydirect",
+		method:              http.MethodPost,
+		cin:                 api.cin,
+		url:                 api.url,
+		clock:               api.clock,
+		strict:              api.strict,
+		maxExpirationWindow: api.maxExpirationWindow,
+		maxClockSkew:        api.maxClockSkew,
+		errorLanguage:       api.errorLanguage,
+		formTemplate:        api.formTemplate,
+		ExpirationTime:      api.now().AddDate(0, 0, 7),
+		Language:            lang,
+		Currency:            curr,
+		Amount:              amount,
+		Description:         description,
+		Invoice:             invoice,
+		URLOk:               urlOk,
+		URLCancel:           urlCancel,
+	}
+
+	// Tag the payment request with the ID of the key it's signed with
+	if api.keyID != "" {
+		if err := p.setField(keyIDField, api.keyID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Loop over the options
+	for _, option := range options {
+		if err := option(&p); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+// now returns the current time according to the clock of the payment request
+func (p *PaymentRequest) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+	return p.clock()
+}
+
+// TimeUntilExpiration returns the time left until the payment request expires
+// The duration is negative if the payment request has already expired
+func (p *PaymentRequest) TimeUntilExpiration() time.Duration {
+	return p.ExpirationTime.Sub(p.now())
+}
+
+// Expired returns true if the expiration time of the payment request has passed
+// The maximum clock skew of the API is tolerated, see WithMaxClockSkew
+func (p *PaymentRequest) Expired() bool {
+	return !p.now().Before(p.ExpirationTime.Add(p.maxClockSkew))
+}
+
+// URL gets the url for execution of the payment request
+// This function is mainly meant to be used in a template
+func (p *PaymentRequest) URL() string {
+	return p.url
+}
+
+// Page gets the page type for the payment request
+// This function is mainly meant to be used in a template
+func (p *PaymentRequest) Page() string {
+	return p.page
+}
+
+// Method gets the HTTP method used to submit the payment form
+// This function is mainly meant to be used in a template
+func (p *PaymentRequest) Method() string {
+	if p.method == "" {
+		return http.MethodPost
+	}
+	return p.method
+}
+
+// FormValues gets the values submitted to ePay by the payment form
+func (p *PaymentRequest) FormValues() url.Values {
+	v := url.Values{}
+	v.Set("PAGE", p.page)
+	v.Set("ENCODED", p.encoded)
+	v.Set("CHECKSUM", p.checksum)
+	if p.Language != "" {
+		v.Set("LANG", p.Language.String())
+	}
+	if p.URLOk != "" {
+		v.Set("URL_OK", p.URLOk)
+	}
+	if p.URLCancel != "" {
+		v.Set("URL_CANCEL", p.URLCancel)
+	}
+	return v
+}
+
+// MarshalForm gets the fields of the payment form, it's used by the template as well as for submitting the form directly
+// The CIN isn't a field of its own, ePay receives it as MIN in ENCODED. An error is returned if p isn't prepared yet.
+func (p *PaymentRequest) MarshalForm() (url.Values, error) {
+	if !p.IsPrepared() {
+		return nil, fmt.Errorf("payment request isn't prepared, the checksum has to be calculated first")
+	}
+	return p.FormValues(), nil
+}
+
+// signedForm encodes p if that hasn't been done yet and gets the fields of the payment form, see API.Prepare
+func (p *PaymentRequest) signedForm() (url.Values, error) {
+	if p.Encoded() == "" {
+		if err := p.encode(); err != nil {
+			return nil, err
+		}
+	}
+	return p.MarshalForm()
+}
+
+// Params gets the signed payload of p as PAGE, URL, ENCODED and CHECKSUM, for integrations which submit it themselves
+func (p *PaymentRequest) Params() (map[string]string, error) {
+	if _, err := p.signedForm(); err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return map[string]string{
+		"PAGE":     p.page,
+		"URL":      p.url,
+		"ENCODED":  p.encoded,
+		"CHECKSUM": p.checksum,
+	}, nil
+}
+
+// GenerateForm renders the form which submits p to ePay with a submit button labelled submitText
+func (p *PaymentRequest) GenerateForm(submitText string) (template.HTML, error) {
+	return p.render(formTemplate, submitText)
+}
+
+// ButtonHTML renders a styled "pay now" button labelled label, which submits p to ePay, for embedding into a page
+func (p *PaymentRequest) ButtonHTML(label string) (template.HTML, error) {
+	return p.render(buttonTemplate, label)
+}
+
+// render executes tpl with the fields of the form which submits p to ePay and submitText as label of the submit button
+func (p *PaymentRequest) render(tpl *template.Template, submitText string) (template.HTML, error) {
+	fields, err := p.signedForm()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	err = tpl.Execute(&b, struct {
+		Action string
+		Method string
+		Fields url.Values
+		Submit string
+	}{p.URL(), p.Method(), fields, submitText})
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+// WriteForm writes the payment page rendered by PaymentRequestHandler to w, e.g. to store it in a file or send it by email
+// p has to be prepared, e.g. via API.Prepare, otherwise an error is returned before anything is written
+func (p *PaymentRequest) WriteForm(w io.Writer) error {
+	if !p.IsPrepared() {
+		return fmt.Errorf("payment request isn't prepared, the checksum has to be calculated first")
+	}
+
+	tpl := p.formTemplate
+	if tpl == nil {
+		tpl = defaultFormTemplate
+	}
+	return tpl.Execute(w, p)
+}
+
+// PaymentURL gets the URL the payment form is submitted to
+// When the form method is GET it's the RedirectURL, for POST the form values are sent in the request body
+func (p *PaymentRequest) PaymentURL() string {
+	if p.Method() != http.MethodGet {
+		return p.url
+	}
+
+	u, err := p.RedirectURL()
+	if err != nil {
+		return p.url
+	}
+	return u
+}
+
+// RedirectURL gets the URL which opens the payment page of ePay with a GET request, e.g. for links in emails or QR codes
+// The page and the signed payload are query arguments, which are escaped, so the base64 of ENCODED survives unchanged.
+func (p *PaymentRequest) RedirectURL() (string, error) {
+	fields, err := p.signedForm()
+	if err != nil {
+		return "", err
+	}
+	return p.url + "?" + fields.Encode(), nil
+}
+
+// ParsePaymentURL extracts the form values, like PAGE, ENCODED and CHECKSUM, from a payment URL, which is mainly useful for debugging
+// It's the inverse of PaymentURL for payment requests using the GET method
+func ParsePaymentURL(rawurl string) (map[string]string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment URL: %v", err)
+	}
+
+	q := u.Query()
+	for _, name := range []string{"ENCODED", "CHECKSUM"} {
+		if q.Get(name) == "" {
+			return nil, fmt.Errorf("payment URL is missing %s", name)
+		}
+	}
+
+	fields := make(map[string]string, len(q))
+	for name := range q {
+		fields[name] = q.Get(name)
+	}
+
+	return fields, nil
+}
+
+// CIN gets the Client Indentification Number
+// This function is mainly meant to be used in a template
+func (p *PaymentRequest) CIN() string {
+	return p.cin
+}
+
+// Encoded gets the encoded payment request
+// This function is mainly meant to be used in a template
+func (p *PaymentRequest) Encoded() string {
+	return p.encoded
+}
+
+// Checksum gets the checksum of the payment request
+// This function is mainly meant to be used in a template
+func (p *PaymentRequest) Checksum() string {
+	return p.checksum
+}
+
+// PaymentRequestHandler is a HandlerFunc for processing payment requests
+// Expects to get the following data are POST or GET arguments:
+// amount: The sum requested from the client (mandatory)
+// description: A description what the payment is for (mandatory, unless WithDefaultDescription is used)
+// invoice: The invoice number (mandatory, unless WithInvoiceGenerator is used)
+// language: The language of epay's user interface (optional) [en*, bg]
+// currency: The currency (optional) [eur*, bgn, usd]
+// The defaults of language and currency can be changed via WithDefaultLanguage and WithDefaultCurrency
+// type: The type of payment (optional) [direct*, login]
+// exp_time: The expiration time as RFC 3339 or ePay's DD.MM.YYYY hh:mm:ss in Sofia time (optional) [now + 7 days*]
+// validate: Only validate the request and return the result as JSON, requires WithValidateOnly (optional) [true]
+func (api *API) PaymentRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// The payment form should never be cached to avoid stale checksums
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+
+	data, err := api.paymentRequestFromForm(r)
+
+	// In validate only mode the result of the validation is returned instead of the payment form
+	if api.validateOnly && r.FormValue("validate") == "true" {
+		if err == nil {
+			err = data.encode()
+		}
+		writeValidationResult(w, err)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Don't render a valid looking payment form for an expired payment request
+	if data.Expired() {
+		if api.expiredHandler != nil {
+			api.expiredHandler.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "payment request has expired", http.StatusGone)
+		return
+	}
+
+	// Calculate the checksum, which fails if the payment request is invalid
+	if err := data.CalcChecksum(api.currentSecret()); err != nil {
+		http.Error(w, fmt.Sprintf("invalid payment request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Render the payment page with the template of the API
+	if err := data.WriteForm(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// paymentRequestFromForm creates a new payment request from the POST or GET arguments of r
+func (api *API) paymentRequestFromForm(r *http.Request) (*PaymentRequest, error) {
+	r.ParseForm()
+
+	// Get the mandatory amount
+	amount, err := strconv.ParseFloat(r.FormValue("amount"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("amount is invalid or missing")
+	}
+
+	// Get the description, which is mandatory unless there's a default description
+	description := r.FormValue("description")
+	if description == "" && api.defaultDescription == "" {
+		return nil, fmt.Errorf("description is empty")
+	}
+
+	// Get the invoice number, which is mandatory unless there's an invoice generator
+	var invoice uint64
+	if v := r.FormValue("invoice"); v != "" || api.invoiceGenerator == nil {
+		invoice, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invoice is invalid or missing")
+		}
+	}
+	if invoice > maxInvoice {
+		return nil, fmt.Errorf("invoice is invalid, must have at most %d digits", maxInvoiceDigits)
+	}
+
+	// Create an empty slice of payment options to collect the options to be executed based upon the optional parameters
+	options := []PaymentOption{}
+
+	// Get the optional language, without it the default language of the API is used
+	if l := r.FormValue("language"); l != "" {
+		lang, err := LanguageFromString(l)
+		if err != nil {
+			return nil, fmt.Errorf("invalid language")
+		}
+		options = append(options, WithLanguage(lang))
+	}
+
+	// Get the optional currency, without it the default currency of the API is used
+	if c := r.FormValue("currency"); c != "" {
+		curr, err := CurrencyFromString(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid currency")
+		}
+		options = append(options, WithCurrency(curr))
+	}
+
+	// Get the optional type
+	switch strings.ToLower(r.FormValue("type")) {
+	// Default type is direct payment (credit / debit card)
+	case "":
+	case "direct":
+		options = append(options, WithPage(Direct))
+	// Payment Request for registered ePay users
+	case "request":
+		options = append(options, WithPage(Login))
+	// Invalid type
+	default:
+		return nil, fmt.Errorf("invalid type")
+	}
+
+	// Get the optional expiration time, a payment request which has already expired is answered by the expired handler
+	if v := r.FormValue("exp_time"); v != "" {
+		exp, err := parseExpirationTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration time")
+		}
+		options = append(options, WithExpirationTime(exp))
+	}
+
+	// Create a new payment request
+	return api.NewPaymentRequest(amount, description, invoice, options...)
+}
+
+// parseExpirationTime parses the exp_time of PaymentRequestHandler, either as RFC 3339 or as ePay's EXP_TIME in Sofia time
+func parseExpirationTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("02.01.2006 15:04:05", v, sofia)
+}
+
+// validationResult is the JSON answer of PaymentRequestHandler in validate only mode
+type validationResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// writeValidationResult writes err as a validationResult to w
+func writeValidationResult(w http.ResponseWriter, err error) {
+	res := validationResult{Valid: true}
+	status := http.StatusOK
+	if err != nil {
+		res = validationResult{Error: err.Error()}
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// PaymentStatus is a custom type to ensure a proper status
+type PaymentStatus string
+
+// String implements the Stringer interface
+func (p PaymentStatus) String() string {
+	return string(p)
+}
+
+var (
+	// Paid means a completed payment
 	Paid PaymentStatus = "PAID"
 
-	// Denied means a failed or cancelled payment
-	Denied PaymentStatus = "DENIED"
+	// Denied means a failed or cancelled payment
+	Denied PaymentStatus = "DENIED"
+
+	// Expired means an expired payment
+	Expired PaymentStatus = "EXPIRED"
+)
+
+// ErrUnknownStatus is the error of payments whose status isn't PAID, DENIED or EXPIRED
+// Callbacks with an unknown status are answered with ERR, so ePay resends them
+var ErrUnknownStatus = errors.New("unknown status")
+
+// PaymentStatusFromString returns the PaymentStatus from a string, regardless of its case
+// An error wrapping ErrUnknownStatus is returned for statuses other than PAID, DENIED and EXPIRED
+func PaymentStatusFromString(s string) (PaymentStatus, error) {
+	switch status := PaymentStatus(strings.ToUpper(strings.TrimSpace(s))); status {
+	case Paid, Denied, Expired:
+		return status, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnknownStatus, s)
+	}
+}
+
+// Payment is a payment done upon a payment request
+type Payment struct {
+	// Invoice number
+	Invoice uint64
+
+	// Status of the payment
+	Status PaymentStatus
+
+	// Payment date and time
+	PayDate time.Time
+
+	// Transaction number
+	Stan int64
+
+	// Authorization code
+	Bcode string
+
+	// TransactionID is ePay's reference of the transaction, which is distinct from the transaction number (Stan)
+	TransactionID string
+
+	// Amount is the amount paid, if ePay echoes it in the callback
+	Amount float64
+
+	// Currency is the currency of the amount, if ePay echoes it in the callback
+	Currency Currency
+
+	// Transaction is the payment mapped by the TransactionMapper set via WithTransactionMapper, if any
+	Transaction any
+}
+
+// A TransactionMapper maps the payments received from ePay onto the transaction type of the application
+type TransactionMapper interface {
+	// MapTransaction returns the transaction for the payment, an error results in the answer ERR to ePay
+	MapTransaction(p Payment) (any, error)
+}
+
+// errEmptySecret is returned when a callback can't be verified, because the API has no secret
+var errEmptySecret = errors.New("secret is empty")
+
+// ErrInvalidChecksum is returned when the checksum of a callback doesn't match its data
+var ErrInvalidChecksum = errors.New("invalid checksum")
+
+// ErrInvalidInvoice is to be returned by payment handlers in case the invoice provided is invalid
+// It's returned by PaymentRequest.Validate for an invalid invoice number as well
+var ErrInvalidInvoice = errors.New("invalid invoice")
+
+// ErrInconsistentCallback is the error of payments whose amount or currency differs from the payment request
+// It's only detected when WithCallbackConsistencyCheck is used
+var ErrInconsistentCallback = errors.New("callback doesn't match the payment request")
+
+// ErrStaleCallback is the error of payments which are older than the age set via WithMaxCallbackAge
+var ErrStaleCallback = errors.New("callback is too old")
+
+// ErrEmptyCIN is returned by PaymentRequest.Validate when the payment request has no CIN
+var ErrEmptyCIN = errors.New("CIN is empty")
+
+// ErrInvalidAmount is returned by PaymentRequest.Validate when the amount is outside of the limits of the currency
+var ErrInvalidAmount = errors.New("Amount is invalid")
+
+// ErrUnsupportedCurrency is returned by PaymentRequest.Validate when the page doesn't support the currency
+var ErrUnsupportedCurrency = errors.New("Currency is not supported")
+
+// ErrInvalidExpiration is returned by PaymentRequest.Validate when the expiration time is missing, has passed or is too far in the future
+var ErrInvalidExpiration = errors.New("Expiration time is invalid")
+
+// PaymentHandlerFunc is a custom type which represents the signature of a payment handler
+// A PaymentHandlerFunc is called by PaymentCallbackHandler after it has processed the callback data received from ePay without any errors. Within a PaymentHandlerFunc
+// should be the logic which connects a payment to the system the libary is being used in, e.g. storing a payment into a database.
+// A successful call and general error handling is done in the normal way by either returning nil or an error, only in case that the reference provided as
+// Payment.Invoice is invalid a PaymentHandlerFunc is expected to return ErrInvalidInvoice, or an error wrapping it.
+// This is important to guarantee that a proper answer is returned to ePay.
+// ctx is the context of the callback request, which is cancelled when the request is, and is to be passed on to e.g.
+// database calls.
+type PaymentHandlerFunc func(ctx context.Context, p Payment) error
+
+// PaymentCallbackHandler returns the HandlerFunc which should be connected to the route serving the URL provided at epay as the notification URL
+// It takes a PaymentHandlerFunc as an argument
+// Handlers registered via RegisterHandlers are called after f
+func (api *API) PaymentCallbackHandler(f PaymentHandlerFunc) http.HandlerFunc {
+	return api.callbackHandler(api.withHandlers(f), nil)
+}
+
+// PaymentInterceptor wraps the processing of every payment of a callback, e.g. to trace it
+// process checks the payment, calls the PaymentHandlerFunc with ctx and returns the answer to ePay for the payment. It's
+// called for payments which are rejected before the PaymentHandlerFunc is called as well.
+type PaymentInterceptor func(ctx context.Context, process func(ctx context.Context) CallbackResult) CallbackResult
+
+// PaymentCallbackHandlerWithInterceptor works like PaymentCallbackHandler, but the processing of every payment is wrapped by i
+func (api *API) PaymentCallbackHandlerWithInterceptor(f PaymentHandlerFunc, i PaymentInterceptor) http.HandlerFunc {
+	return api.callbackHandler(api.withHandlers(f), i)
+}
+
+// callbackHandler returns the HandlerFunc which processes callbacks with f, wrapping every payment with i if it isn't nil
+func (api *API) callbackHandler(f PaymentHandlerFunc, i PaymentInterceptor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// A panic while processing a callback must never crash the server, ePay retries the callback instead
+		defer func() {
+			if v := recover(); v != nil {
+				api.logf("panic while processing callback: %v", v)
+				api.callbackProcessed(nil, start)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
+
+		res, code, err := api.processCallback(r, f, i)
+		if err != nil {
+			api.callbackProcessed(nil, start)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		api.callbackProcessed(res, start)
+
+		// Send the answer to the ePay server
+		api.writeAnswer(w, res)
+	}
+}
+
+// writeAnswer writes the answer to an ePay callback, which is a line per invoice unless WithResponseBuilder is used
+// The headers and status are written exactly once, ePay retries the notification if the answer deviates from its format
+func (api *API) writeAnswer(w http.ResponseWriter, results CallbackResults) {
+	status, answer := http.StatusOK, []byte(results.String())
+	if api.responseBuilder != nil {
+		status, answer = api.responseBuilder(results)
+	}
+
+	w.Header().Set("Content-Type", api.answerContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(answer)))
+	w.WriteHeader(status)
+	w.Write(answer)
+}
+
+// RegisterHandlers registers additional PaymentHandlerFuncs which are called for every callback, e.g. to notify several subsystems
+// All handlers are called, the answer to ePay is "OK" only if all of them succeed and "NO" if any of them returns ErrInvalidInvoice
+func (api *API) RegisterHandlers(handlers ...PaymentHandlerFunc) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.handlers = append(api.handlers, handlers...)
+}
+
+// withHandlers returns a PaymentHandlerFunc which calls f and all registered handlers
+// ErrInvalidInvoice is returned if any of the handlers returned it, otherwise all other errors are combined
+func (api *API) withHandlers(f PaymentHandlerFunc) PaymentHandlerFunc {
+	return func(ctx context.Context, p Payment) error {
+		// The registered handlers are read on every call, so handlers registered after the route was built are called too
+		api.mu.RLock()
+		handlers := make([]PaymentHandlerFunc, 0, len(api.handlers)+1)
+		if f != nil {
+			handlers = append(handlers, f)
+		}
+		handlers = append(handlers, api.handlers...)
+		api.mu.RUnlock()
+
+		var errs []error
+		invalid := false
+		for _, h := range handlers {
+			if err := h(ctx, p); err != nil {
+				if errors.Is(err, ErrInvalidInvoice) {
+					invalid = true
+					continue
+				}
+				errs = append(errs, err)
+			}
+		}
+
+		if invalid {
+			return ErrInvalidInvoice
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// Metrics is implemented by collectors of metrics about the processing of the API
+// The subpackage epayprom provides an implementation for Prometheus
+type Metrics interface {
+	// CallbackProcessed is called once per callback after it has been processed with the statuses answered to ePay for its
+	// invoices and the duration of the processing. The statuses are empty for callbacks which have been rejected as a whole,
+	// e.g. because of an invalid checksum.
+	CallbackProcessed(statuses []string, d time.Duration)
+
+	// OutboundRequest is called after a request to ePay with the duration of the request and its error, if any
+	OutboundRequest(d time.Duration, err error)
+}
+
+// callbackProcessed informs the metrics about a processed callback with results, which started at start
+func (api *API) callbackProcessed(results CallbackResults, start time.Time) {
+	if api.metrics == nil {
+		return
+	}
+
+	statuses := make([]string, len(results))
+	for i, res := range results {
+		statuses[i] = res.Status
+	}
+	api.metrics.CallbackProcessed(statuses, time.Since(start))
+}
+
+// CallbackResult is the result of processing an ePay callback
+type CallbackResult struct {
+	// Invoice number
+	Invoice uint64
+
+	// Status is the status answered to ePay, which can be OK, NO or ERR
+	Status string
+
+	// Err is the error which caused the status to be NO or ERR
+	Err error
+
+	// CIN is echoed in the answer as MIN if it's set, see WithCINInAnswer
+	CIN string
+
+	// Payment is the payment the answer is for, as far as it could be parsed
+	Payment Payment
+}
+
+// String returns the answer for the ePay server
+func (res CallbackResult) String() string {
+	if res.CIN != "" {
+		return fmt.Sprintf("INVOICE=%d:STATUS=%s:MIN=%s\n", res.Invoice, res.Status, res.CIN)
+	}
+	return fmt.Sprintf("INVOICE=%d:STATUS=%s\n", res.Invoice, res.Status)
+}
+
+// CallbackResults are the results of all invoices of an ePay callback, a single callback can contain several invoices
+type CallbackResults []CallbackResult
+
+// String returns the answer for the ePay server, which contains a line per invoice
+func (results CallbackResults) String() string {
+	var b strings.Builder
+	for _, res := range results {
+		b.WriteString(res.String())
+	}
+	return b.String()
+}
+
+// BuildAnswer returns the answer for the ePay server for results, which is a line per invoice like INVOICE=123:STATUS=OK
+// It's meant for custom handlers and tests, which have to produce the exact answer PaymentCallbackHandler does
+func BuildAnswer(results []CallbackResult) string {
+	return CallbackResults(results).String()
+}
+
+// ProcessCallback verifies and parses the ePay callback in r and calls f with every payment it contains
+// The returned CallbackResults are what PaymentCallbackHandler answers to ePay, which allows custom handlers to do their own response handling
+// An error is returned in case r isn't a valid callback
+func (api *API) ProcessCallback(r *http.Request, f PaymentHandlerFunc) (CallbackResults, error) {
+	res, _, err := api.processCallback(r, api.withHandlers(f), nil)
+	return res, err
+}
+
+// processCallback does the actual work of ProcessCallback, every payment is wrapped by i if it isn't nil
+// In case of an error the HTTP status code to respond with is returned as well
+func (api *API) processCallback(r *http.Request, f PaymentHandlerFunc, i PaymentInterceptor) (CallbackResults, int, error) {
+	// Verify and decode the callback
+	data, code, err := api.decodeCallback(r)
+	if err == errEmptySecret {
+		return CallbackResults{{Status: "ERR", Err: err, CIN: api.answerCIN()}}, http.StatusOK, nil
+	}
+	if err != nil {
+		return nil, code, err
+	}
+
+	// Answer replayed callbacks like the original one
+	encoded := r.FormValue("encoded")
+	if api.replay != nil {
+		if results, ok := api.replay.get(encoded, api.now()); ok {
+			api.logf("callback replayed")
+			return results, http.StatusOK, nil
+		}
+	}
+
+	// Reject batches which are too large without processing any of their payments, ePay resends them
+	payments := splitPayments(data)
+	if api.maxBatchSize > 0 && len(payments) > api.maxBatchSize {
+		api.logf("rejecting callback with %d invoices, the maximum is %d", len(payments), api.maxBatchSize)
+		err := fmt.Errorf("callback contains %d invoices, the maximum is %d", len(payments), api.maxBatchSize)
+		results := make(CallbackResults, len(payments))
+		for i, fields := range payments {
+			results[i] = CallbackResult{Invoice: invoiceOf(fields), Status: "ERR", Err: err, CIN: api.answerCIN()}
+		}
+		return results, http.StatusOK, nil
+	}
+
+	// Every payment gets its own status, so one failing invoice doesn't affect the others
+	var results CallbackResults
+	for _, fields := range payments {
+		process := func(ctx context.Context) CallbackResult {
+			return api.processPayment(ctx, fields, f)
+		}
+		if i != nil {
+			results = append(results, i(r.Context(), process))
+		} else {
+			results = append(results, process(r.Context()))
+		}
+	}
+
+	if api.replay != nil {
+		api.replay.put(encoded, api.now(), results)
+	}
+	return results, http.StatusOK, nil
+}
+
+// processPayment parses the fields of a single payment of a callback and calls f with it and ctx
+func (api *API) processPayment(ctx context.Context, fields []string, f PaymentHandlerFunc) CallbackResult {
+	// Parse the fields into a payment
+	payment, err := api.parsePayment(fields, api.strictCallbacks)
+	res := CallbackResult{Invoice: payment.Invoice, CIN: api.answerCIN(), Payment: payment}
+	if err != nil {
+		res.Status = "ERR"
+		res.Err = err
+		return res
+	}
+
+	// Reject payments which are too old, the age is judged by the clock of the API, so tests can freeze it
+	if api.maxCallbackAge > 0 && !payment.PayDate.IsZero() {
+		if age := api.now().Sub(payment.PayDate); age > api.maxCallbackAge {
+			api.logf("stale callback for invoice %d, paid %v ago", payment.Invoice, age)
+			res.Status = "NO"
+			res.Err = fmt.Errorf("%w: paid %v ago", ErrStaleCallback, age)
+			return res
+		}
+	}
+
+	// Reject status transitions which aren't allowed for the invoice, e.g. a late PAID for an expired invoice
+	if api.transitionValidator != nil {
+		if err := api.transitionValidator(payment.Invoice, payment.Status); err != nil {
+			api.logf("rejected status %s for invoice %d: %v", payment.Status, payment.Invoice, err)
+			res.Status = "NO"
+			res.Err = err
+			return res
+		}
+	}
+
+	// Reject payments which don't match the payment request
+	if api.consistencyLookup != nil {
+		if err := api.checkConsistency(ctx, payment); err != nil {
+			api.logf("inconsistent callback for invoice %d: %v", payment.Invoice, err)
+			res.Status = "ERR"
+			if errors.Is(err, ErrInconsistentCallback) {
+				res.Status = "NO"
+			}
+			res.Err = err
+			return res
+		}
+	}
+
+	// Map the payment onto the transaction type of the application
+	if api.mapper != nil {
+		if payment.Transaction, err = api.mapper.MapTransaction(payment); err != nil {
+			api.logf("transaction mapper error: %v", err)
+			res.Status = "ERR"
+			res.Err = err
+			return res
+		}
+		res.Payment.Transaction = payment.Transaction
+	}
+
+	// Call the PaymentHandlerFunc
+	if err := f(ctx, payment); err != nil {
+		res.Err = err
+		// The invoice number is unkown or invalid, so status has to be set to "NO"
+		if errors.Is(err, ErrInvalidInvoice) {
+			res.Status = "NO"
+		} else { // Another error occured, so the status has to be set to "ERR"
+			api.logf("payment handler error: %v", err)
+			res.Status = "ERR"
+		}
+		return res
+	}
+
+	// No error was returned by the PaymentHandlerFunc, so the status should be "OK"
+	res.Status = "OK"
+	return res
+}
+
+// answerCIN returns the CIN to echo in answers to ePay, which is empty unless WithCINInAnswer is used
+func (api *API) answerCIN() string {
+	if !api.cinInAnswer {
+		return ""
+	}
+	return api.cin
+}
+
+// decodeCallback verifies the checksum of the callback data posted by ePay and returns the decoded payload
+// In case of an error the HTTP status code to respond with is returned as well
+func (api *API) decodeCallback(r *http.Request) (string, int, error) {
+	// Ensure that we only accept POST calls
+	if r.Method != http.MethodPost {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid method")
+	}
+
+	// Decompress gzipped bodies, because ParseForm doesn't handle them
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		if err := gunzipBody(r); err != nil {
+			return "", http.StatusBadRequest, err
+		}
+	}
+
+	// Parse the form
+	if err := r.ParseForm(); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	// Never verify without a secret, because a checksum forged with an empty key would match
+	secret, err := api.callbackSecret(r)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if secret == "" {
+		api.logf("rejecting callback, because the secret is empty")
+		return "", http.StatusInternalServerError, errEmptySecret
+	}
+
+	// Get encoded and checksum via the form or parameters
+	data, err := api.verifyCallback(secret, r.FormValue("encoded"), r.FormValue("checksum"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	return data, http.StatusOK, nil
+}
+
+// verifyCallback verifies the received checksum of the encoded callback data with secret and returns the decoded payload
+func (api *API) verifyCallback(secret, encoded, received string) (string, error) {
+	// Check if the checksum is what we expected
+	if !VerifyChecksum(secret, encoded, received) {
+		// Only the received checksum is logged, the expected one would sign data chosen by whoever sent the callback
+		api.logf("invalid checksum %q", received)
+		if api.debug {
+			api.logf("debug: received encoded %q with checksum %q", encoded, received)
+		}
+		return "", fmt.Errorf("%w %q", ErrInvalidChecksum, received)
+	}
+
+	// Decode the payload
+	d, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decoding error: %v", err)
+	}
+
+	// Pass the verified data to the observer, e.g. for archiving
+	if api.rawCallbackObserver != nil {
+		api.rawCallbackObserver(encoded, string(d), received)
+	}
+
+	// Convert the payload to a string
+	return string(d), nil
+}
+
+// ParseCallback verifies and parses the encoded data and checksum of an ePay callback, e.g. when callbacks are received via a
+// message queue instead of PaymentCallbackHandler
+// ErrInvalidChecksum is returned if the checksum doesn't match. If payments fail to parse, all payments are returned along
+// with the errors. Callbacks tagged with a key ID have to be parsed with ParseCallbackWithKeyID.
+func (api *API) ParseCallback(encoded, checksum string) ([]Payment, error) {
+	return api.ParseCallbackWithKeyID("", encoded, checksum)
+}
+
+// ParseCallbackWithKeyID works like ParseCallback, but verifies the checksum with the secret of key id from the key set
+// The secret of the API is used if id is empty, like for callbacks received by PaymentCallbackHandler without a key ID.
+func (api *API) ParseCallbackWithKeyID(id, encoded, checksum string) ([]Payment, error) {
+	secret, err := api.keySecret(id)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, errEmptySecret
+	}
+
+	data, err := api.verifyCallback(secret, encoded, checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		payments []Payment
+		errs     []error
+	)
+	for _, fields := range splitPayments(data) {
+		payment, err := api.parsePayment(fields, api.strictCallbacks)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		payments = append(payments, payment)
+	}
+	return payments, errors.Join(errs...)
+}
+
+// gzipBody is the decompressed body of a request which closes the original body as well
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the gzip reader and the original body
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// gunzipBody replaces the gzipped body of r by the decompressed body
+func gunzipBody(r *http.Request) error {
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return fmt.Errorf("invalid gzip body: %v", err)
+	}
+
+	r.Body = gzipBody{Reader: zr, body: r.Body}
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+	return nil
+}
+
+// payTimeLayouts are the layouts of PAY_TIME, ePay uses YYYYMMDDhhmmss
+var payTimeLayouts = []string{"20060102150405", "02.01.2006 15:04:05"}
+
+// splitPayments splits the decoded callback payload into the fields of every payment it contains
+// ePay sends a line per invoice with the fields separated by colons, e.g. INVOICE=123:STATUS=PAID:PAY_TIME=20240101120000.
+// A line per field is supported as well, a new payment starts at every INVOICE field. At least one, possibly empty, payment is returned.
+func splitPayments(data string) [][]string {
+	var (
+		payments [][]string
+		current  []string
+		invoice  bool
+	)
+	for _, line := range strings.Split(data, "\n") {
+		for _, f := range splitFields(strings.TrimRight(line, "\r")) {
+			if strings.TrimSpace(f) == "" {
+				continue
+			}
+
+			name, _, _ := strings.Cut(f, "=")
+			if strings.ToUpper(strings.TrimSpace(name)) == "INVOICE" {
+				if invoice {
+					payments = append(payments, current)
+					current = nil
+				}
+				invoice = true
+			}
+			current = append(current, f)
+		}
+	}
+
+	return append(payments, current)
+}
+
+// splitFields splits a line of the callback payload on the colons which separate the fields
+// Colons which aren't followed by a field name, like the ones of a time, are part of the value
+func splitFields(line string) []string {
+	var fields []string
+	start := 0
+	for i := 0; i < len(line); i++ {
+		if line[i] == ':' && startsWithFieldName(line[i+1:]) {
+			fields = append(fields, line[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(fields, line[start:])
+}
+
+// startsWithFieldName returns true if s starts with a field name followed by an equal sign
+func startsWithFieldName(s string) bool {
+	name, _, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePayment parses the fields of a single payment of the decoded callback payload into a Payment
+// If a field fails to parse the remaining fields are still processed and an error is returned along with the payment
+// Unknown statuses are always errors, in strict mode unknown fields are errors as well, otherwise they're ignored
+func (api *API) parsePayment(fields []string, strict bool) (Payment, error) {
+	var perr error
+
+	// Create an empty payment and loop over all fields to process them
+	payment := Payment{}
+	for _, f := range fields {
+		// Split the field on the first equal sign, fields without one are malformed
+		name, value, ok := strings.Cut(f, "=")
+		if !ok && strings.TrimSpace(name) != "" {
+			api.logf("malformed field %q", f)
+			perr = fmt.Errorf("malformed field %q", f)
+			continue
+		}
+
+		// The name can be INVOICE, STATUS, PAY_TIME, STAN, AMOUNT, CURRENCY, BCODE, TRANSACTION_ID
+		// The name is normalized to upper case to be tolerant for differently cased keys
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case "INVOICE": // Invoice number
+			i, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				api.logf("failed to parse invoice %v: %v", value, err)
+				perr = fmt.Errorf("invalid invoice %q", value)
+			}
+			payment.Invoice = i
+		case "STATUS": // Status can be PAID, DENIED or EXPIRED
+			// Unknown statuses are kept as they are, but the payment can't be acknowledged
+			status, err := PaymentStatusFromString(value)
+			if err != nil {
+				api.logf("unknown status %q", value)
+				perr = err
+				status = PaymentStatus(value)
+			}
+			payment.Status = status
+		case "PAY_TIME": // Data and time of payment
+			t, err := parsePayTime(value)
+			if err != nil {
+				api.logf("failed to parse dateTime %q: %v", value, err)
+				perr = fmt.Errorf("invalid pay time %q", value)
+			}
+			payment.PayDate = t
+		case "STAN": // Transaction number
+			s, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				api.logf("failed to parse stan %v: %v", value, err)
+				perr = fmt.Errorf("invalid stan %q", value)
+			}
+			payment.Stan = s
+		case "AMOUNT": // Amount paid
+			a, err := parseAmount(value)
+			if err != nil {
+				api.logf("failed to parse amount %v: %v", value, err)
+				perr = fmt.Errorf("invalid amount %q", value)
+			}
+			payment.Amount = a
+		case "CURRENCY": // Currency of the amount
+			payment.Currency = Currency(strings.ToUpper(strings.TrimSpace(value)))
+		case "BCODE": // Authorization number
+			payment.Bcode = value
+		case "TRANSACTION_ID": // Transaction reference
+			payment.TransactionID = value
+		case "": // Empty field
+		default:
+			if strict {
+				api.logf("unknown field %q", name)
+				perr = fmt.Errorf("unknown field %q", name)
+			}
+		}
+	}
+
+	return payment, perr
+}
+
+// invoiceOf returns the invoice number in the fields of a payment without parsing the other fields, or 0 if there's none
+func invoiceOf(fields []string) uint64 {
+	for _, f := range fields {
+		name, value, _ := strings.Cut(f, "=")
+		if strings.EqualFold(strings.TrimSpace(name), "INVOICE") {
+			invoice, _ := strconv.ParseUint(value, 10, 64)
+			return invoice
+		}
+	}
+	return 0
+}
+
+// parsePayTime parses the value of PAY_TIME in any of the payTimeLayouts, which is in the local time of Bulgaria
+func parsePayTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range payTimeLayouts {
+		t, perr := time.ParseInLocation(layout, value, sofia)
+		if perr == nil {
+			return t, nil
+		}
+		err = perr
+	}
+	return time.Time{}, err
+}
+
+// contextKey is the type of the keys used to store values in a context
+type contextKey int
+
+const (
+	apiContextKey contextKey = iota
+	paymentContextKey
+)
+
+// CallbackMiddleware verifies and parses the ePay callback and stores the API and the parsed payments in the request context
+// before calling next, so later handlers in the chain can access them via APIFromContext and PaymentFromContext
+// Callbacks which fail verification or parsing are rejected with a 400 status
+func (api *API) CallbackMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, code, err := api.decodeCallback(r)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		var payments []Payment
+		for _, fields := range splitPayments(data) {
+			payment, err := api.parsePayment(fields, api.strictCallbacks)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			payments = append(payments, payment)
+		}
+
+		ctx := context.WithValue(r.Context(), apiContextKey, api)
+		ctx = context.WithValue(ctx, paymentContextKey, payments)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// APIFromContext returns the API which processed the callback stored in ctx by CallbackMiddleware
+func APIFromContext(ctx context.Context) (*API, bool) {
+	api, ok := ctx.Value(apiContextKey).(*API)
+	return api, ok
+}
+
+// PaymentFromContext returns the Payment stored in ctx by CallbackMiddleware
+// For callbacks with several invoices it's the first payment, use PaymentsFromContext to get all of them
+func PaymentFromContext(ctx context.Context) (Payment, bool) {
+	payments, ok := PaymentsFromContext(ctx)
+	if !ok {
+		return Payment{}, false
+	}
+	return payments[0], true
+}
+
+// PaymentsFromContext returns all payments of the callback stored in ctx by CallbackMiddleware
+func PaymentsFromContext(ctx context.Context) ([]Payment, bool) {
+	payments, ok := ctx.Value(paymentContextKey).([]Payment)
+	return payments, ok && len(payments) > 0
+}
+
+// CallbackHandlerWithTimeout works like PaymentCallbackHandler, but bounds the execution of the PaymentHandlerFunc by d
+// If the PaymentHandlerFunc doesn't return in time the status "ERR" is returned to ePay, so the notification will be retried later
+// This is meant for servers which don't have global read/write timeouts configured
+func (api *API) CallbackHandlerWithTimeout(d time.Duration, f PaymentHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		// Wrap the PaymentHandlerFunc, so it's abandoned when the deadline passes even if it ignores ctx
+		f := api.withHandlers(f)
+		h := func(ctx context.Context, p Payment) error {
+			done := make(chan error, 1)
+			go func() {
+				// The recover of callbackHandler doesn't cover this goroutine, so a panic is answered with ERR here
+				defer func() {
+					if v := recover(); v != nil {
+						api.logf("panic in payment handler for invoice %d: %v", p.Invoice, v)
+						done <- fmt.Errorf("payment handler panic: %v", v)
+					}
+				}()
+				done <- f(ctx, p)
+			}()
+
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return fmt.Errorf("payment handler timeout: %v", ctx.Err())
+			}
+		}
+
+		api.callbackHandler(h, nil)(w, r.WithContext(ctx))
+	}
+}
+
+// retrySchedule contains the intervals after which ePay resends a notification which wasn't answered with OK or NO
+var retrySchedule = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+	8 * time.Hour,
+	24 * time.Hour,
+}
+
+// RetrySchedule returns the intervals after which ePay resends a notification which wasn't answered with OK or NO
+// The intervals are relative to the previous attempt, which can be used to set expectations, e.g. for the TTL of deduplication
+func RetrySchedule() []time.Duration {
+	return append([]time.Duration(nil), retrySchedule...)
+}
+
+// Option is an API opion
+type Option func(*API) error
+
+// WithDemoURL will set the API to use the demo instead of production URL
+// It's recommended to use this option during development
+func WithDemoURL() Option {
+	return func(api *API) error {
+		api.url = ePayDemoURL
+		return nil
+	}
+}
 
-	// Expired means an expired payment
-	Expired PaymentStatus = "EXPIRED"
-)
+// WithProductionURL will set the API to use the production URL
+// This is the default, the option only makes the choice explicit
+func WithProductionURL() Option {
+	return func(api *API) error {
+		api.url = ePayURL
+		return nil
+	}
+}
 
-// Payment is a payment done upon a payment request
-type Payment struct {
-	// Invoice number
-	Invoice uint64
+// WithCustomURL will set the API to use u instead of one of ePay's URLs, e.g. for a staging proxy or a mock server
+// The URL must be an absolute http or https URL, a trailing slash is added if it's missing
+func WithCustomURL(u string) Option {
+	return func(api *API) error {
+		v, err := validateURL(u)
+		if err != nil {
+			return err
+		}
 
-	// Status of the payment
-	Status PaymentStatus
+		if !strings.HasSuffix(v, "/") {
+			v += "/"
+		}
+		api.url = v
+		return nil
+	}
+}
 
-	// Payment date and time
-	PayDate time.Time
+// WithMaxExpirationWindow overrides how far in the future the expiration time of payment requests can be
+// By default it's 30 days
+func WithMaxExpirationWindow(d time.Duration) Option {
+	return func(api *API) error {
+		if d <= 0 {
+			return fmt.Errorf("max expiration window must be positive")
+		}
 
-	// Transaction number
-	Stan int64
+		api.maxExpirationWindow = d
+		return nil
+	}
+}
 
-	// Authorization code
-	Bcode string
+// WithMaxClockSkew tolerates clock differences of up to d when checking if a payment request has expired, which
+// PaymentRequest.Validate does as well. Payment requests created right at the expiration boundary aren't rejected then.
+// By default there's no tolerance.
+func WithMaxClockSkew(d time.Duration) Option {
+	return func(api *API) error {
+		if d < 0 {
+			return fmt.Errorf("max clock skew can't be negative")
+		}
+
+		api.maxClockSkew = d
+		return nil
+	}
 }
 
-// ErrInvalidInvoice is to be returned by payment handlers in case the invoice provided is invalid
-var ErrInvalidInvoice = errors.New("invalid invoice")
+// WithClock overrides the function used to get the current time, which is mainly useful for testing
+func WithClock(clock func() time.Time) Option {
+	return func(api *API) error {
+		if clock == nil {
+			return fmt.Errorf("clock is nil")
+		}
 
-// PaymentHandlerFunc is a custom type which represents the signature of a payment handler
-// A PaymentHandlerFunc is called by PaymentCallbackHandler after it has processed the callback data received from ePay without any errors. Within a PaymentHandlerFunc
-// should be the logic which connects a payment to the system the libary is being used in, e.g. storing a payment into a database.
-// A successful call and general error handling is done in the normal way by either returning nil or an error, only in case that the reference provided as
-// Payment.Invoice is invalid a PaymentHandlerFunc is expected to return ErrInvalidInvoice.
-// This is important to guarantee that a proper answer is returned to ePay.
-type PaymentHandlerFunc func(p Payment) error
+		api.clock = clock
+		return nil
+	}
+}
 
-// PaymentCallbackHandler returns the HandlerFunc which should be connected to the route serving the URL provided at epay as the notification URL
-// It takes a PaymentHandlerFunc as an argument
-func (api *API) PaymentCallbackHandler(f PaymentHandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Ensure that we only accept POST calls
-		if r.Method != http.MethodPost {
-			http.Error(w, "invalid method", http.StatusBadRequest)
-			return
+// WithSecretFile reads the secret key from the file at path, e.g. a secret mounted into a container
+// Trailing newlines are trimmed. The secret from the file overrides the secret provided to New.
+func WithSecretFile(path string) Option {
+	return func(api *API) error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read secret file: %v", err)
 		}
 
-		// Parse the form
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		secret := strings.TrimRight(string(b), "\r\n")
+		if secret == "" {
+			return fmt.Errorf("secret file %q is empty", path)
 		}
 
-		// Get encoded and checksum via the form or parameters
-		encoded := r.FormValue("encoded")
-		checksum := r.FormValue("checksum")
+		api.secret = NewSecret(secret)
+		return nil
+	}
+}
+
+// WithStrictMode enables the strict mode of the API, in which payment requests are validated more strictly
+// In strict mode an empty description is an error, unless it's waived by the WithNoDescription option
+func WithStrictMode() Option {
+	return func(api *API) error {
+		api.strict = true
+		return nil
+	}
+}
 
-		// Calculate the expected checksum
-		h := hmac.New(sha1.New, []byte(api.secret))
-		h.Write([]byte(encoded))
-		expected := hex.EncodeToString(h.Sum(nil))
+// WithFormTemplate sets the template of the payment form rendered by PaymentRequestHandler
+// The template is executed with the PaymentRequest, MarshalForm provides its form fields. By default an embedded template is used.
+func WithFormTemplate(t *template.Template) Option {
+	return func(api *API) error {
+		if t == nil {
+			return fmt.Errorf("form template is nil")
+		}
 
-		// Check if the checksum is what we expected
-		if checksum != expected {
-			http.Error(w, fmt.Sprintf("invalid checksum %q", checksum), http.StatusBadRequest)
-			log.Printf("expected checksum %q, but got %q", expected, checksum)
-			return
+		api.formTemplate = t
+		return nil
+	}
+}
+
+// WithMetrics sets the Metrics which are informed about the processing of the API
+func WithMetrics(m Metrics) Option {
+	return func(api *API) error {
+		api.metrics = m
+		return nil
+	}
+}
+
+// WithValidateOnly enables the validate only mode of PaymentRequestHandler
+// When the validate=true argument is provided, the payment request is built and validated and the result is returned as JSON
+// instead of rendering the payment form. This allows client-side form validation round-trips.
+func WithValidateOnly() Option {
+	return func(api *API) error {
+		api.validateOnly = true
+		return nil
+	}
+}
+
+// WithAnswerContentType overrides the content type of the answer to ePay's callbacks, which is text/plain by default
+func WithAnswerContentType(contentType string) Option {
+	return func(api *API) error {
+		if contentType == "" {
+			return fmt.Errorf("content type is empty")
 		}
 
-		// Decode the payload
-		d, err := base64.StdEncoding.DecodeString(encoded)
+		api.answerContentType = contentType
+		return nil
+	}
+}
+
+// WithProxyURL routes the requests to ePay via the HTTP proxy at proxy
+func WithProxyURL(proxy string) Option {
+	return func(api *API) error {
+		u, err := url.Parse(proxy)
 		if err != nil {
-			http.Error(w, "decoding error: "+err.Error(), http.StatusBadRequest)
-			return
+			return fmt.Errorf("invalid proxy URL: %v", err)
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q", proxy)
 		}
-		// Convert the payload to a string
-		data := string(d)
 
-		status := ""
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = http.ProxyURL(u)
+		api.client = &http.Client{Transport: t, Timeout: defaultHTTPTimeout}
+		return nil
+	}
+}
 
-		// Split the payload on newline
-		parts := strings.Split(data, "\n")
+// WithHTTPClient sets the HTTP client used for all requests to ePay, e.g. to configure timeouts or the transport
+// By default a client with a timeout of 30 seconds is used
+func WithHTTPClient(c *http.Client) Option {
+	return func(api *API) error {
+		if c == nil {
+			return fmt.Errorf("HTTP client is nil")
+		}
 
-		// Create an empty payment and loop over all parts to process them
-		payment := Payment{}
-		for _, part := range parts {
-			// Split the part by the equal sign
-			e := strings.Split(part, "=")
+		api.client = c
+		return nil
+	}
+}
 
-			// The first element reprents the field name, which can be INVOICE, STATUS, PAY_TIME, STAN, BCODE
-			switch e[0] {
-			case "INVOICE": // Invoice number
-				i, err := strconv.ParseUint(e[1], 10, 64)
-				if err != nil {
-					log.Printf("failed to parse invoice %v: %v", e[1], err)
-					status = "ERR"
-				}
-				payment.Invoice = i
-			case "STATUS": // Status can be PAID, DENIED or EXPIRED
-				payment.Status = PaymentStatus(e[1])
-			case "PAY_TIME": // Data and time of payment
-				t, err := time.Parse("02.01.2006 15:04:05", e[1])
-				if err != nil {
-					log.Printf("failed to arse dateTime %q: %v", e[1], err)
-					status = "ERR"
-				}
-				payment.PayDate = t
-			case "STAN": // Transaction number
-				s, err := strconv.ParseInt(e[1], 10, 64)
-				if err != nil {
-					log.Printf("failed to parse stan %v: %v", e[1], err)
-					status = "ERR"
-				}
-				payment.Stan = s
-			case "BCODE": // Authorization number
-				payment.Bcode = e[1]
-			}
+// WithLogger sends the diagnostic messages of the API to l instead of the standard logger
+func WithLogger(l Logger) Option {
+	return func(api *API) error {
+		if l == nil {
+			return fmt.Errorf("logger can't be nil")
 		}
 
-		// If there hasn't been an error PaymentHandlerFunc processing can start
-		if status != "ERR" {
-			// Call the PaymentHandlerFunc
-			if err := f(payment); err != nil {
-				// The invoice number is unkown or invalid, so status has to be set to "NO"
-				if err == ErrInvalidInvoice {
-					status = "NO"
-				} else { // Another error occured, so the status has to be set to "ERR"
-					log.Printf("payment handler error: %v", err)
-					status = "ERR"
-				}
-			} else { // No error was returned by the PaymentHandlerFunc, so the status should be "OK"
-				status = "OK"
-			}
+		api.logger = l
+		return nil
+	}
+}
+
+// logf writes a diagnostic message to the logger set via WithLogger, or to the standard logger
+func (api *API) logf(format string, v ...any) {
+	if api.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	api.logger.Printf(format, v...)
+}
+
+// WithDebug enables debug logging, e.g. of the received data of callbacks which fail verification
+// The secret is never logged
+func WithDebug() Option {
+	return func(api *API) error {
+		api.debug = true
+		return nil
+	}
+}
+
+// WithResponseBuilder sets the function which builds the status and body of the answers to callbacks from the results
+// This gives full control over the answer, by default it's the status 200 with a line per invoice as built by BuildAnswer
+func WithResponseBuilder(f func(results []CallbackResult) (status int, body []byte)) Option {
+	return func(api *API) error {
+		if f == nil {
+			return fmt.Errorf("response builder is nil")
 		}
 
-		// Prepare and send the answer to the ePay server
-		answer := fmt.Sprintf("INVOICE=%d:STATUS=%s\n", payment.Invoice, status)
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(answer))
+		api.responseBuilder = f
+		return nil
 	}
 }
 
-// Option is an API opion
-type Option func(*API) error
+// WithCINInAnswer echoes the CIN as MIN in the answers to callbacks, e.g. INVOICE=123:STATUS=OK:MIN=456
+// ePay's documented answer format doesn't contain the CIN, so only enable this if your ePay account expects it
+func WithCINInAnswer() Option {
+	return func(api *API) error {
+		api.cinInAnswer = true
+		return nil
+	}
+}
 
-// WithDemoURL will set the API to use the demo instead of production URL
-// It's recommended to use this option during development
-func WithDemoURL() Option {
+// WithRawCallbackObserver sets a function which receives the raw data of every verified callback
+// This allows to archive the exact received bytes, e.g. for audits
+func WithRawCallbackObserver(f func(encoded, decoded, checksum string)) Option {
 	return func(api *API) error {
-		api.url = ePayDemoURL
+		api.rawCallbackObserver = f
+		return nil
+	}
+}
+
+// WithExpiredHandler sets the handler which is called by PaymentRequestHandler for expired payment requests
+// By default a 410 Gone status is returned
+func WithExpiredHandler(h http.Handler) Option {
+	return func(api *API) error {
+		api.expiredHandler = h
+		return nil
+	}
+}
+
+// WithTransactionMapper maps every payment received in a callback onto a transaction using m
+// The PaymentHandlerFunc receives the transaction in Payment.Transaction, next to the fields of the payment itself.
+func WithTransactionMapper(m TransactionMapper) Option {
+	return func(api *API) error {
+		if m == nil {
+			return fmt.Errorf("transaction mapper can't be nil")
+		}
+
+		api.mapper = m
+		return nil
+	}
+}
+
+// WithStatusTransitionValidator sets the function which is consulted before the PaymentHandlerFunc for every payment
+// It's meant to reject statuses which the invoice can't change to anymore, e.g. because callbacks were delivered out of
+// order. A rejected payment isn't passed to the PaymentHandlerFunc and is answered with NO, so ePay doesn't resend it.
+func WithStatusTransitionValidator(f func(invoice uint64, newStatus PaymentStatus) error) Option {
+	return func(api *API) error {
+		if f == nil {
+			return fmt.Errorf("status transition validator can't be nil")
+		}
+
+		api.transitionValidator = f
+		return nil
+	}
+}
+
+// WithCallbackConsistencyCheck compares the amount and currency echoed in callbacks with those of the payment request
+// lookup returns the amount and currency of the payment request of an invoice, e.g. from the database of the application.
+// Payments which don't match are answered with NO and aren't passed to the PaymentHandlerFunc, an error returned by lookup
+// is answered with ERR, so ePay resends the callback. Fields which aren't echoed in the callback aren't compared.
+func WithCallbackConsistencyCheck(lookup func(ctx context.Context, invoice uint64) (amount float64, currency Currency, err error)) Option {
+	return func(api *API) error {
+		if lookup == nil {
+			return fmt.Errorf("consistency lookup can't be nil")
+		}
+
+		api.consistencyLookup = lookup
+		return nil
+	}
+}
+
+// checkConsistency compares the amount and currency of payment with those of its payment request
+// An error wrapping ErrInconsistentCallback is returned if they differ
+func (api *API) checkConsistency(ctx context.Context, payment Payment) error {
+	amount, currency, err := api.consistencyLookup(ctx, payment.Invoice)
+	if err != nil {
+		return fmt.Errorf("consistency lookup failed: %w", err)
+	}
+
+	if payment.Currency != "" && payment.Currency != currency {
+		return fmt.Errorf("%w: currency is %s instead of %s", ErrInconsistentCallback, payment.Currency, currency)
+	}
+
+	// The amounts are compared in cents to ignore floating point differences
+	if payment.Amount != 0 && math.Round(payment.Amount*100) != math.Round(amount*100) {
+		return fmt.Errorf("%w: amount is %.2f instead of %.2f", ErrInconsistentCallback, payment.Amount, amount)
+	}
+	return nil
+}
+
+// WithMaxCallbackAge rejects payments whose PAY_TIME is more than d ago, e.g. to limit the window for replayed callbacks
+// Stale payments are answered with NO and aren't passed to the PaymentHandlerFunc. Payments without PAY_TIME are accepted.
+// The age is determined with the clock set via WithClock.
+func WithMaxCallbackAge(d time.Duration) Option {
+	return func(api *API) error {
+		if d <= 0 {
+			return fmt.Errorf("max callback age must be positive")
+		}
+
+		api.maxCallbackAge = d
+		return nil
+	}
+}
+
+// WithMaxBatchSize limits the number of invoices in a single callback to n
+// Callbacks with more invoices aren't processed at all, every invoice is answered with ERR
+func WithMaxBatchSize(n int) Option {
+	return func(api *API) error {
+		if n <= 0 {
+			return fmt.Errorf("max batch size must be positive")
+		}
+
+		api.maxBatchSize = n
+		return nil
+	}
+}
+
+// WithStrictCallbackParsing makes unknown fields in callbacks an error, which is answered with "ERR"
+// By default they're ignored, unknown statuses are always an error. Strict parsing surfaces changes of ePay's protocol early.
+func WithStrictCallbackParsing() Option {
+	return func(api *API) error {
+		api.strictCallbacks = true
+		return nil
+	}
+}
+
+// WithDemoCIN sets the Client Identification Number which is used instead of the regular one when the demo URL is used
+// This allows switching between demo and production with WithDemoURL only
+func WithDemoCIN(cin string) Option {
+	return func(api *API) error {
+		api.demoCIN = cin
+		return nil
+	}
+}
+
+// WithInvoiceGenerator sets the function which assigns the invoice numbers of payment requests created with invoice 0
+// It's called concurrently if payment requests are created concurrently, and has to return unique invoice numbers of at
+// most 10 digits, e.g. from a counter or based on the current time
+func WithInvoiceGenerator(f func() uint64) Option {
+	return func(api *API) error {
+		if f == nil {
+			return fmt.Errorf("invoice generator can't be nil")
+		}
+
+		api.invoiceGenerator = f
+		return nil
+	}
+}
+
+// WithDefaultCurrency sets the currency of all payment requests instead of EUR
+// It can be overridden per payment request via WithCurrency
+func WithDefaultCurrency(c Currency) Option {
+	return func(api *API) error {
+		if _, ok := amountLimits[c]; !ok {
+			return fmt.Errorf("unsupported currency %q", c)
+		}
+
+		api.defaultCurrency = c
+		return nil
+	}
+}
+
+// WithDefaultLanguage sets the language of all payment requests instead of English
+// It can be overridden per payment request via WithLanguage
+func WithDefaultLanguage(l Language) Option {
+	return func(api *API) error {
+		if l != English && l != Bulgarian {
+			return fmt.Errorf("unsupported language %q", l)
+		}
+
+		api.defaultLanguage = l
+		return nil
+	}
+}
+
+// WithDefaultDescription sets the description of all payment requests which are created without one
+// It can be overridden per payment request and waived via WithNoDescription
+func WithDefaultDescription(description string) Option {
+	return func(api *API) error {
+		if strings.TrimSpace(description) == "" {
+			return fmt.Errorf("default description can't be empty")
+		}
+
+		api.defaultDescription = description
+		return nil
+	}
+}
+
+// WithDefaultURLOk sets the URL the client will be redirected to after payment for all payment requests
+// It can be overridden per payment request
+func WithDefaultURLOk(u string) Option {
+	return func(api *API) error {
+		v, err := validateURL(u)
+		if err != nil {
+			return err
+		}
+
+		api.urlOk = v
+		return nil
+	}
+}
+
+// WithDefaultURLCancel sets the URL the client will be redirected to after cancelling payment for all payment requests
+// It can be overridden per payment request
+func WithDefaultURLCancel(u string) Option {
+	return func(api *API) error {
+		v, err := validateURL(u)
+		if err != nil {
+			return err
+		}
+
+		api.urlCancel = v
 		return nil
 	}
 }
@@ -574,9 +2577,10 @@ func WithDemoURL() Option {
 func New(cin, secret string, options ...Option) (*API, error) {
 	// Create a new API instance
 	api := API{
-		cin:    cin,
-		secret: secret,
-		url:    ePayURL,
+		cin:               cin,
+		secret:            NewSecret(secret),
+		url:               ePayURL,
+		answerContentType: defaultAnswerContentType,
 	}
 
 	// Loop over the provided options
@@ -586,5 +2590,37 @@ func New(cin, secret string, options ...Option) (*API, error) {
 		}
 	}
 
+	// Use the demo CIN when the demo URL is used
+	if api.url == ePayDemoURL && api.demoCIN != "" {
+		api.cin = api.demoCIN
+	}
+
+	// Sign with the secret of the key ID
+	if err := api.useKeyID(); err != nil {
+		return nil, err
+	}
+
 	return &api, nil
 }
+
+// Sign returns the hex encoded hmac/sha1 checksum of data signed with the secret of the API
+func (api *API) Sign(data string) string {
+	return Checksum(api.currentSecret(), data)
+}
+
+// Verify checks if signature is the checksum of data signed with the secret of the API
+// The comparison is done in constant time. Verification always fails if the secret is empty.
+func (api *API) Verify(data, signature string) bool {
+	return VerifyChecksum(api.currentSecret(), data, signature)
+}
+
+// CIN returns the Client Identification Number of the API as a number
+// Returns an error if the CIN isn't numeric, which can be used to validate the CIN for accounts with a numeric MIN
+func (api *API) CIN() (uint64, error) {
+	cin, err := strconv.ParseUint(strings.TrimSpace(api.cin), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("CIN %q is not numeric", api.cin)
+	}
+
+	return cin, nil
+}
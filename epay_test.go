@@ -1,7 +1,31 @@
 package epay
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	// Embed the time zone database, so the tests don't depend on the one of the system
+	_ "time/tzdata"
+
+	"golang.org/x/net/html"
 )
 
 func TestNew(t *testing.T) {
@@ -14,8 +38,8 @@ func TestNew(t *testing.T) {
 		t.Fatalf("expected URL to be %q, but got %q", ePayURL, api.url)
 	}
 
-	if expected := "test"; api.secret != expected {
-		t.Fatalf("expected secret to be %q, but got %q", expected, api.secret)
+	if expected := "test"; api.secret.Expose() != expected {
+		t.Fatalf("expected secret to be %q, but got %q", expected, api.secret.Expose())
 	}
 }
 
@@ -29,3 +53,3440 @@ func TestWithDemoURL(t *testing.T) {
 		t.Fatalf("expected URL to be %q, but got %q", ePayDemoURL, api.url)
 	}
 }
+
+func TestWithProductionURL(t *testing.T) {
+	api, err := New("cin", "test", WithDemoURL(), WithProductionURL())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if api.url != ePayURL {
+		t.Fatalf("expected URL to be %q, but got %q", ePayURL, api.url)
+	}
+}
+
+func TestWithCustomURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+		fail     bool
+	}{
+		{"trailing slash", "https://staging.example.com/epay/", "https://staging.example.com/epay/", false},
+		{"no trailing slash", "http://localhost:8080", "http://localhost:8080/", false},
+		{"relative", "/epay/", "", true},
+		{"no scheme", "staging.example.com", "", true},
+		{"unsupported scheme", "ftp://staging.example.com/", "", true},
+		{"malformed", "https://staging example.com/", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := New("cin", "test", WithCustomURL(tt.url))
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected, but got URL %q", tt.url, api.url)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+			if api.url != tt.expected {
+				t.Fatalf("expected URL to be %q, but got %q", tt.expected, api.url)
+			}
+		})
+	}
+}
+
+func TestWithDemoCIN(t *testing.T) {
+	api, err := New("cin", "test", WithDemoCIN("democin"), WithDemoURL())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "democin"; api.cin != expected {
+		t.Fatalf("expected CIN to be %q, but got %q", expected, api.cin)
+	}
+
+	api, err = New("cin", "test", WithDemoCIN("democin"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "cin"; api.cin != expected {
+		t.Fatalf("expected CIN to be %q, but got %q", expected, api.cin)
+	}
+}
+
+func TestCIN(t *testing.T) {
+	api, err := New("1234567890", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	cin, err := api.CIN()
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := uint64(1234567890); cin != expected {
+		t.Fatalf("expected CIN to be %d, but got %d", expected, cin)
+	}
+
+	api, err = New("D123456", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := api.CIN(); err == nil {
+		t.Fatal("expected an error for a non-numeric CIN, but got nil")
+	}
+}
+
+func TestWithDefaultURLs(t *testing.T) {
+	api, err := New("cin", "test", WithDefaultURLOk("https://example.com/ok"), WithDefaultURLCancel("https://example.com/cancel"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "https://example.com/ok"; p.URLOk != expected {
+		t.Fatalf("expected URLOk to be %q, but got %q", expected, p.URLOk)
+	}
+
+	if expected := "https://example.com/cancel"; p.URLCancel != expected {
+		t.Fatalf("expected URLCancel to be %q, but got %q", expected, p.URLCancel)
+	}
+
+	override := func(p *PaymentRequest) error {
+		p.URLOk = "https://example.com/other"
+		return nil
+	}
+
+	p, err = api.NewPaymentRequest(10, "test", 1, override)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "https://example.com/other"; p.URLOk != expected {
+		t.Fatalf("expected URLOk to be %q, but got %q", expected, p.URLOk)
+	}
+
+	if expected := "https://example.com/cancel"; p.URLCancel != expected {
+		t.Fatalf("expected URLCancel to be %q, but got %q", expected, p.URLCancel)
+	}
+}
+
+func TestWithDefaultCurrencyAndLanguage(t *testing.T) {
+	api, err := New("cin", "test", WithDefaultCurrency(BGN), WithDefaultLanguage(Bulgarian))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if p.Currency != BGN || p.Language != Bulgarian {
+		t.Fatalf("expected BGN and Bulgarian, but got %s and %s", p.Currency, p.Language)
+	}
+
+	// Options of the payment request override the defaults
+	p, err = api.NewPaymentRequest(10, "test", 1, WithCurrency(USD), WithLanguage(English))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if p.Currency != USD || p.Language != English {
+		t.Fatalf("expected USD and English, but got %s and %s", p.Currency, p.Language)
+	}
+
+	// Without defaults the currency is EUR and the language is English
+	api, err = New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	p, err = api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if p.Currency != EUR || p.Language != English {
+		t.Fatalf("expected EUR and English, but got %s and %s", p.Currency, p.Language)
+	}
+
+	if _, err := New("cin", "test", WithDefaultCurrency("GBP")); err == nil {
+		t.Fatal("expected to fail for an unsupported currency, but got no error")
+	}
+	if _, err := New("cin", "test", WithDefaultLanguage("de")); err == nil {
+		t.Fatal("expected to fail for an unsupported language, but got no error")
+	}
+}
+
+func TestWithDefaultDescription(t *testing.T) {
+	api, err := New("cin", "test", WithDefaultDescription("Order"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if expected := "Order"; p.Description != expected {
+		t.Fatalf("expected description to be %q, but got %q", expected, p.Description)
+	}
+
+	p, err = api.NewPaymentRequest(10, "Subscription", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if expected := "Subscription"; p.Description != expected {
+		t.Fatalf("expected description to be %q, but got %q", expected, p.Description)
+	}
+
+	// The handler only requires a description without a default
+	for _, tt := range []struct {
+		name     string
+		options  []Option
+		expected int
+	}{
+		{"default", []Option{WithDefaultDescription("Order")}, http.StatusOK},
+		{"no default", nil, http.StatusInternalServerError},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := New("cin", "test", tt.options...)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&invoice=1", nil))
+			if w.Code != tt.expected {
+				t.Fatalf("expected status %d, but got %d", tt.expected, w.Code)
+			}
+		})
+	}
+
+	if _, err := New("cin", "test", WithDefaultDescription(" ")); err == nil {
+		t.Fatal("expected to fail for an empty default description, but got no error")
+	}
+}
+
+func TestWithInvoiceGenerator(t *testing.T) {
+	var next uint64 = 1000
+	api, err := New("cin", "test", WithInvoiceGenerator(func() uint64 {
+		next++
+		return next
+	}))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	seen := map[uint64]bool{}
+	for i := 0; i < 3; i++ {
+		p, err := api.NewPaymentRequest(10, "test", 0)
+		if err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+
+		if expected := uint64(1001 + i); p.Invoice != expected {
+			t.Fatalf("expected invoice to be %d, but got %d", expected, p.Invoice)
+		}
+		if seen[p.Invoice] {
+			t.Fatalf("expected distinct invoices, but got %d twice", p.Invoice)
+		}
+		seen[p.Invoice] = true
+
+		if err := p.Validate(); err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+	}
+
+	// A supplied invoice isn't replaced
+	p, err := api.NewPaymentRequest(10, "test", 42)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if expected := uint64(42); p.Invoice != expected {
+		t.Fatalf("expected invoice to be %d, but got %d", expected, p.Invoice)
+	}
+
+	// The handler doesn't require an invoice with a generator
+	w := httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Generated invoices have to be valid
+	api, err = New("cin", "test", WithInvoiceGenerator(func() uint64 { return 0 }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if _, err := api.NewPaymentRequest(10, "test", 0); err == nil {
+		t.Fatal("expected to fail for a generated invoice 0, but got no error")
+	}
+
+	if _, err := New("cin", "test", WithInvoiceGenerator(nil)); err == nil {
+		t.Fatal("expected to fail for a nil generator, but got no error")
+	}
+}
+
+func TestWithValidateOnly(t *testing.T) {
+	api, err := New("cin", "test", WithValidateOnly())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   string
+	}{
+		{"valid", "amount=10&description=test&invoice=1&validate=true", http.StatusOK, `{"valid":true}`},
+		{"invalid amount", "amount=0&description=test&invoice=1&validate=true", http.StatusBadRequest, `{"valid":false,"error":"Amount is invalid, must be between 0.01 and 50000.00 EUR"}`},
+		{"missing description", "amount=10&invoice=1&validate=true", http.StatusBadRequest, `{"valid":false,"error":"description is empty"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?"+tt.query, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, but got %d", tt.status, w.Code)
+			}
+
+			if body := strings.TrimSpace(w.Body.String()); body != tt.body {
+				t.Fatalf("expected body %s, but got %s", tt.body, body)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	api, err := New("cin", "key")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected, got := "de7c9b85b8b78aa6bc8a7a36f70a90701c9db4d9", api.Sign("The quick brown fox jumps over the lazy dog"); got != expected {
+		t.Fatalf("expected signature to be %q, but got %q", expected, got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	api, err := New("cin", "key")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	data := "The quick brown fox jumps over the lazy dog"
+	if !api.Verify(data, "de7c9b85b8b78aa6bc8a7a36f70a90701c9db4d9") {
+		t.Fatal("expected a matching signature to verify")
+	}
+
+	if api.Verify(data, "de7c9b85b8b78aa6bc8a7a36f70a90701c9db4d0") {
+		t.Fatal("expected a non-matching signature not to verify")
+	}
+
+	if api.Verify(data+".", "de7c9b85b8b78aa6bc8a7a36f70a90701c9db4d9") {
+		t.Fatal("expected a signature of other data not to verify")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	const (
+		secret   = "secret"
+		encoded  = "TUlOPWNpbgpJTlZPSUNFPTEK"
+		expected = "85c49028f4a397d98e455243d0c84be9de03657c"
+	)
+
+	if got := Checksum(secret, encoded); got != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, got)
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		encoded  string
+		checksum string
+		valid    bool
+	}{
+		{"valid", secret, encoded, expected, true},
+		{"upper case", secret, encoded, strings.ToUpper(expected), true},
+		{"tampered data", secret, "TUlOPWNpbgpJTlZPSUNFPTIK", expected, false},
+		{"tampered checksum", secret, encoded, "85c49028f4a397d98e455243d0c84be9de03657d", false},
+		{"wrong secret", "wrong", encoded, expected, false},
+		{"empty secret", "", encoded, Checksum("", encoded), false},
+		{"malformed checksum", secret, encoded, "xyz", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyChecksum(tt.secret, tt.encoded, tt.checksum); got != tt.valid {
+				t.Fatalf("expected verification to be %v, but got %v", tt.valid, got)
+			}
+		})
+	}
+}
+
+// newCallbackRequest creates a signed ePay callback request carrying data
+func newCallbackRequest(secret, data string) *http.Request {
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(encoded))
+
+	form := url.Values{}
+	form.Set("encoded", encoded)
+	form.Set("checksum", hex.EncodeToString(h.Sum(nil)))
+
+	r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestCallbackHandlerWithTimeout(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	slow := func(ctx context.Context, p Payment) error {
+		time.Sleep(500 * time.Millisecond)
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	api.CallbackHandlerWithTimeout(10*time.Millisecond, slow)(w, newCallbackRequest("test", "INVOICE=123\nSTATUS=PAID"))
+
+	if expected := "INVOICE=123:STATUS=ERR\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	fast := func(ctx context.Context, p Payment) error {
+		return nil
+	}
+
+	w = httptest.NewRecorder()
+	api.CallbackHandlerWithTimeout(time.Second, fast)(w, newCallbackRequest("test", "INVOICE=123\nSTATUS=PAID"))
+
+	if expected := "INVOICE=123:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
+
+func TestCallbackContextCancelled(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The handler blocks until its context is done, so it only returns if the cancellation reaches it
+	f := func(ctx context.Context, p Payment) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID").WithContext(ctx))
+		done <- w
+	}()
+
+	select {
+	case w := <-done:
+		if expected := "INVOICE=1:STATUS=ERR\n"; w.Body.String() != expected {
+			t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the handler to observe the cancellation, but it hangs")
+	}
+}
+
+func TestCallbackCaseInsensitiveKeys(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var got Payment
+	f := func(ctx context.Context, p Payment) error {
+		got = p
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", "invoice=123\nStatus=PAID\nPay_Time=02.01.2006 15:04:05\nstan=456\nBCode=abc"))
+
+	if expected := "INVOICE=123:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	expected := Payment{
+		Invoice: 123,
+		Status:  Paid,
+		PayDate: time.Date(2006, 1, 2, 15, 4, 5, 0, sofia),
+		Stan:    456,
+		Bcode:   "abc",
+	}
+	if got != expected {
+		t.Fatalf("expected payment to be %+v, but got %+v", expected, got)
+	}
+}
+
+func TestExpirationTimeInSofia(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		exp      time.Time
+		expected string
+	}{
+		{"winter", time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), "EXP_TIME=15.01.2024 12:00:00"},
+		{"summer", time.Date(2024, 7, 15, 10, 0, 0, 0, time.UTC), "EXP_TIME=15.07.2024 13:00:00"},
+		{"date change", time.Date(2024, 7, 15, 22, 30, 0, 0, time.UTC), "EXP_TIME=16.07.2024 01:30:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := tt.exp.Add(-time.Hour)
+			api.clock = func() time.Time { return now }
+			p, err := api.NewPaymentRequest(10, "test", 1, WithExpirationTime(tt.exp))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if err := p.encode(); err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			d, _ := base64.StdEncoding.DecodeString(p.encoded)
+			if !strings.Contains(string(d), tt.expected+"\n") {
+				t.Fatalf("expected %q in the encoded data, but got %q", tt.expected, d)
+			}
+		})
+	}
+}
+
+func TestPayTimeInSofia(t *testing.T) {
+	for _, value := range []string{"20240715130000", "15.07.2024 13:00:00"} {
+		got, err := parsePayTime(value)
+		if err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+
+		if expected := time.Date(2024, 7, 15, 10, 0, 0, 0, time.UTC); !got.Equal(expected) {
+			t.Fatalf("expected %q to be %v, but got %v", value, expected, got.UTC())
+		}
+	}
+}
+
+func TestCallbackMiddleware(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var (
+		got    Payment
+		gotAPI *API
+	)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if got, ok = PaymentFromContext(r.Context()); !ok {
+			t.Fatal("expected a payment in the context")
+		}
+		if gotAPI, ok = APIFromContext(r.Context()); !ok {
+			t.Fatal("expected an API in the context")
+		}
+	})
+
+	w := httptest.NewRecorder()
+	api.CallbackMiddleware(next).ServeHTTP(w, newCallbackRequest("test", "INVOICE=123\nSTATUS=PAID"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	if got.Invoice != 123 || got.Status != Paid {
+		t.Fatalf("expected invoice 123 with status %q, but got %+v", Paid, got)
+	}
+
+	if gotAPI != api {
+		t.Fatal("expected the API in the context to be the processing API")
+	}
+
+	w = httptest.NewRecorder()
+	api.CallbackMiddleware(next).ServeHTTP(w, newCallbackRequest("wrong", "INVOICE=123\nSTATUS=PAID"))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, but got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestEncodeMaxLength(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err = api.NewPaymentRequest(10, strings.Repeat("x", maxEncodedLength), 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err == nil {
+		t.Fatal("expected an error for an oversized description, but got nil")
+	}
+
+	if p.Encoded() != "" {
+		t.Fatalf("expected no encoded data, but got %q", p.Encoded())
+	}
+}
+
+func TestCalcChecksumReencodes(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.CalcChecksum("test"); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	first := p.Checksum()
+
+	// Changing a field directly is picked up by the next checksum
+	p.Amount = 20
+	if err := p.CalcChecksum("test"); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if p.Checksum() == first {
+		t.Fatal("expected the checksum to change with the amount")
+	}
+
+	d, _ := base64.StdEncoding.DecodeString(p.Encoded())
+	if !strings.Contains(string(d), "\nAMOUNT=20.00\n") {
+		t.Fatalf("expected the new amount in the encoded data, but got %q", d)
+	}
+
+	if expected := Checksum("test", p.Encoded()); p.Checksum() != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, p.Checksum())
+	}
+}
+
+func TestEncodedLength(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		description string
+		options     []PaymentOption
+	}{
+		{"short", "test", nil},
+		{"utf-8", "тест", []PaymentOption{WithCharset("utf-8")}},
+		{"cp1251", "тест", []PaymentOption{WithCharset("cp1251")}},
+		{"fields", "test", []PaymentOption{WithLogoURL("https://example.com/logo.png"), WithTheme(DarkTheme)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := api.NewPaymentRequest(10, tt.description, 1, tt.options...)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			n, err := p.EncodedLength()
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			// The estimate doesn't store anything
+			if p.Encoded() != "" {
+				t.Fatalf("expected no encoded data, but got %q", p.Encoded())
+			}
+
+			if err := p.encode(); err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+			if expected := len(p.Encoded()); n != expected {
+				t.Fatalf("expected length %d, but got %d", expected, n)
+			}
+		})
+	}
+
+	// Oversized data is measured instead of rejected
+	p, err := api.NewPaymentRequest(10, strings.Repeat("x", maxEncodedLength), 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	n, err := p.EncodedLength()
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if n <= maxEncodedLength {
+		t.Fatalf("expected a length above %d, but got %d", maxEncodedLength, n)
+	}
+}
+
+func TestRequiredAndOptionalFields(t *testing.T) {
+	api, err := New("cin", "unused", WithDefaultURLOk("https://example.com/ok"), WithDefaultURLCancel("https://example.com/cancel"),
+		WithKeySet(map[string]string{"1": "test"}), WithKeyID("1"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// All fields are set, so the encoded data contains all required and optional fields in order
+	p, err := api.NewPaymentRequest(10, "test", 1, WithTheme(DarkTheme), WithLogoURL("https://example.com/logo.png"),
+		WithMerchantName("Shop"), WithCharset("utf-8"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, _ := base64.StdEncoding.DecodeString(p.Encoded())
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(string(d)), "\n") {
+		name, _, _ := strings.Cut(line, "=")
+		names = append(names, name)
+	}
+
+	if expected := append(RequiredFields(), OptionalFields()...); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the fields %v, but got %v", expected, names)
+	}
+
+	// Without the optional fields only the required fields are encoded
+	api, err = New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err = api.NewPaymentRequest(10, "", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	p.Currency, p.Language = "", ""
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, _ = base64.StdEncoding.DecodeString(p.Encoded())
+	names = nil
+	for _, line := range strings.Split(strings.TrimSpace(string(d)), "\n") {
+		name, _, _ := strings.Cut(line, "=")
+		names = append(names, name)
+	}
+
+	if expected := RequiredFields(); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the fields %v, but got %v", expected, names)
+	}
+}
+
+func TestWithLogoURLAndTheme(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithLogoURL("https://example.com/logo.png"), WithTheme(LightTheme), WithTheme(DarkTheme))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, expected := range []string{"LOGO=https://example.com/logo.png\n", "THEME=dark\n"} {
+		if !strings.Contains(string(d), expected) {
+			t.Fatalf("expected encoded data to contain %q, but got %q", expected, d)
+		}
+	}
+
+	if strings.Contains(string(d), "THEME=light") {
+		t.Fatalf("expected overridden theme to be absent, but got %q", d)
+	}
+
+	for _, logoURL := range []string{"", "logo.png", "http://example.com/logo.png", "https://example.com/logo.png\nAMOUNT=1"} {
+		if _, err := api.NewPaymentRequest(10, "test", 1, WithLogoURL(logoURL)); err == nil {
+			t.Fatalf("expected an error for logo URL %q, but got nil", logoURL)
+		}
+	}
+
+	for _, theme := range []Theme{"", "blue"} {
+		if _, err := api.NewPaymentRequest(10, "test", 1, WithTheme(theme)); err == nil {
+			t.Fatalf("expected an error for theme %q, but got nil", theme)
+		}
+	}
+}
+
+func TestProcessCallback(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		handler PaymentHandlerFunc
+		status  string
+	}{
+		{"ok", "INVOICE=1\nSTATUS=PAID", func(ctx context.Context, p Payment) error { return nil }, "OK"},
+		{"invalid invoice", "INVOICE=2\nSTATUS=PAID", func(ctx context.Context, p Payment) error { return ErrInvalidInvoice }, "NO"},
+		{"handler error", "INVOICE=3\nSTATUS=PAID", func(ctx context.Context, p Payment) error { return fmt.Errorf("db down") }, "ERR"},
+		{"parse error", "INVOICE=4\nSTAN=x", func(ctx context.Context, p Payment) error { return nil }, "ERR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := api.ProcessCallback(newCallbackRequest("test", tt.data), tt.handler)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if expected := 1; len(results) != expected {
+				t.Fatalf("expected %d result, but got %d", expected, len(results))
+			}
+			res := results[0]
+
+			if res.Status != tt.status {
+				t.Fatalf("expected status %q, but got %q", tt.status, res.Status)
+			}
+
+			if (res.Err != nil) != (tt.status != "OK") {
+				t.Fatalf("expected an error only for a non OK status, but got %v", res.Err)
+			}
+
+			w := httptest.NewRecorder()
+			api.PaymentCallbackHandler(tt.handler)(w, newCallbackRequest("test", tt.data))
+			if w.Body.String() != results.String() {
+				t.Fatalf("expected answer to be %q, but got %q", results.String(), w.Body.String())
+			}
+		})
+	}
+
+	if _, err := api.ProcessCallback(newCallbackRequest("wrong", "INVOICE=1\nSTATUS=PAID"), nil); err == nil {
+		t.Fatal("expected an error for an invalid checksum, but got nil")
+	}
+}
+
+func TestEncodeAmountLimits(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		currency Currency
+		amount   float64
+		valid    bool
+	}{
+		{BGN, 0.009, false},
+		{BGN, 0.01, true},
+		{BGN, 100000, true},
+		{BGN, 100000.01, false},
+		{EUR, 0.009, false},
+		{EUR, 0.01, true},
+		{EUR, 50000, true},
+		{EUR, 50000.01, false},
+		{USD, 0.009, false},
+		{USD, 0.01, true},
+		{USD, 50000, true},
+		{USD, 50000.01, false},
+		{"", 100000, true},
+		{"GBP", 10, false},
+	}
+
+	for _, tt := range tests {
+		p, err := api.NewPaymentRequest(tt.amount, "test", 1, WithCurrency(tt.currency))
+		if err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+
+		err = p.encode()
+		if tt.valid && err != nil {
+			t.Fatalf("expected %.3f %s to be valid, but got %v", tt.amount, tt.currency, err)
+		}
+		if !tt.valid && err == nil {
+			t.Fatalf("expected %.3f %s to be invalid, but got nil", tt.amount, tt.currency)
+		}
+	}
+}
+
+func TestWithCharset(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "Тест", 1, WithCharset("cp1251"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := []byte{0xD2, 0xE5, 0xF1, 0xF2}; !bytes.Contains(d, expected) {
+		t.Fatalf("expected encoded data to contain %x, but got %x", expected, d)
+	}
+
+	if bytes.Contains(d, []byte("Тест")) {
+		t.Fatal("expected encoded data not to contain UTF-8")
+	}
+
+	p, err = api.NewPaymentRequest(10, "Тест", 1, WithCharset("utf-8"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, err = base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if !bytes.Contains(d, []byte("Тест")) || !bytes.Contains(d, []byte("ENCODING=utf-8\n")) {
+		t.Fatalf("expected UTF-8 encoded data, but got %q", d)
+	}
+
+	if _, err := api.NewPaymentRequest(10, "test", 1, WithCharset("latin1")); err == nil {
+		t.Fatal("expected an error for an unsupported charset, but got nil")
+	}
+}
+
+func TestRegisterHandlersAfterRoute(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The route is built before the handler is registered, e.g. when subsystems start after the HTTP server
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })
+	api.RegisterHandlers(func(ctx context.Context, p Payment) error { return fmt.Errorf("analytics down") })
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=ERR\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
+
+func TestRegisterHandlers(t *testing.T) {
+	ok := func(ctx context.Context, p Payment) error { return nil }
+	invalid := func(ctx context.Context, p Payment) error { return ErrInvalidInvoice }
+	failing := func(ctx context.Context, p Payment) error { return fmt.Errorf("analytics down") }
+
+	tests := []struct {
+		name     string
+		handlers []PaymentHandlerFunc
+		expected string
+	}{
+		{"all success", []PaymentHandlerFunc{ok, ok}, "OK"},
+		{"one invalid", []PaymentHandlerFunc{ok, invalid, failing}, "NO"},
+		{"one failing", []PaymentHandlerFunc{ok, failing}, "ERR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := New("cin", "test")
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			calls := 0
+			count := func(ctx context.Context, p Payment) error {
+				calls++
+				return nil
+			}
+
+			api.RegisterHandlers(tt.handlers...)
+			api.RegisterHandlers(count)
+
+			w := httptest.NewRecorder()
+			api.PaymentCallbackHandler(ok)(w, newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID"))
+
+			if expected := "INVOICE=1:STATUS=" + tt.expected + "\n"; w.Body.String() != expected {
+				t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+			}
+
+			if calls != 1 {
+				t.Fatalf("expected all handlers to be called, but the last one was called %d times", calls)
+			}
+		})
+	}
+}
+
+func TestWithValidationHook(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	errTooHigh := fmt.Errorf("EUR amounts must be below 1000")
+	hook := WithValidationHook(func(p *PaymentRequest) error {
+		if p.Currency == EUR && p.Amount >= 1000 {
+			return errTooHigh
+		}
+		return nil
+	})
+
+	p, err := api.NewPaymentRequest(1500, "test", 1, WithCurrency(EUR), hook)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); !errors.Is(err, errTooHigh) {
+		t.Fatalf("expected error %v, but got %v", errTooHigh, err)
+	}
+
+	p, err = api.NewPaymentRequest(1500, "test", 1, WithCurrency(BGN), hook)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+}
+
+func TestTimeUntilExpiration(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := 7 * 24 * time.Hour; p.TimeUntilExpiration() != expected {
+		t.Fatalf("expected %v until expiration, but got %v", expected, p.TimeUntilExpiration())
+	}
+
+	p, err = api.NewPaymentRequest(10, "test", 1, WithExpirationTime(now.Add(-time.Hour)))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := -time.Hour; p.TimeUntilExpiration() != expected {
+		t.Fatalf("expected %v until expiration, but got %v", expected, p.TimeUntilExpiration())
+	}
+}
+
+func TestWithSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("filesecret\n"), 0600); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	api, err := New("cin", "", WithSecretFile(path))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "filesecret"; api.secret.Expose() != expected {
+		t.Fatalf("expected secret to be %q, but got %q", expected, api.secret.Expose())
+	}
+
+	if _, err := New("cin", "", WithSecretFile(filepath.Join(t.TempDir(), "missing"))); err == nil {
+		t.Fatal("expected an error for a missing secret file, but got nil")
+	}
+}
+
+func TestWithNormalizedDescription(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "  Order   #123\t for\n  John  ", 1, WithNormalizedDescription())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "Order #123 for John"; p.Description != expected {
+		t.Fatalf("expected description to be %q, but got %q", expected, p.Description)
+	}
+}
+
+func TestWithNoDescription(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected an empty description to pass outside strict mode, but got %v", err)
+	}
+
+	api, err = New("cin", "test", WithStrictMode())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err = api.NewPaymentRequest(10, "", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err == nil {
+		t.Fatal("expected an error for an empty description in strict mode, but got nil")
+	}
+
+	p, err = api.NewPaymentRequest(10, "", 1, WithNoDescription())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected a waived description to pass in strict mode, but got %v", err)
+	}
+}
+
+func TestWithURLOkParams(t *testing.T) {
+	api, err := New("cin", "test", WithDefaultURLOk("https://example.com/ok?lang=bg"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithURLOkParams(url.Values{"order": {"123 & 456"}}))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "https://example.com/ok?lang=bg&order=123+%26+456"; p.URLOk != expected {
+		t.Fatalf("expected URLOk to be %q, but got %q", expected, p.URLOk)
+	}
+
+	api, err = New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := api.NewPaymentRequest(10, "test", 1, WithURLOkParams(url.Values{"order": {"123"}})); err == nil {
+		t.Fatal("expected an error for an empty URLOk, but got nil")
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected string
+		valid    bool
+	}{
+		{"https://example.com/ok", "https://example.com/ok", true},
+		{"https://пример.бг/ok?order=1", "https://xn--e1afmkfd.xn--90ae/ok?order=1", true},
+		{"http://Пример.БГ:8080/ok", "http://xn--e1afmkfd.xn--90ae:8080/ok", true},
+		{"ftp://example.com/ok", "", false},
+		{"/ok", "", false},
+		{"https:///ok", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := validateURL(tt.raw)
+		if tt.valid && err != nil {
+			t.Fatalf("expected %q to be valid, but got %v", tt.raw, err)
+		}
+		if !tt.valid && err == nil {
+			t.Fatalf("expected %q to be invalid, but got nil", tt.raw)
+		}
+		if got != tt.expected {
+			t.Fatalf("expected %q to be normalized to %q, but got %q", tt.raw, tt.expected, got)
+		}
+	}
+
+	api, err := New("cin", "test", WithDefaultURLOk("https://пример.бг/ok"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "https://xn--e1afmkfd.xn--90ae/ok"; api.urlOk != expected {
+		t.Fatalf("expected default URLOk to be %q, but got %q", expected, api.urlOk)
+	}
+
+	if _, err := New("cin", "test", WithDefaultURLCancel("example.com/cancel")); err == nil {
+		t.Fatal("expected an error for a relative URL, but got nil")
+	}
+}
+
+func TestWithFormMethod(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tpl, err := template.ParseFiles("templates/simplepaymentrequest.html")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			p, err := api.NewPaymentRequest(10, "test", 1, WithFormMethod(strings.ToLower(method)))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if err := p.CalcChecksum("test"); err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := tpl.Execute(&buf, p); err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if expected := "method=" + method + ">"; !strings.Contains(buf.String(), expected) {
+				t.Fatalf("expected form to contain %q, but got %s", expected, buf.String())
+			}
+
+			u, err := url.Parse(p.PaymentURL())
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			q := u.Query()
+			if method == http.MethodGet {
+				if q.Get("ENCODED") != p.Encoded() || q.Get("CHECKSUM") != p.Checksum() || q.Get("PAGE") != p.Page() {
+					t.Fatalf("expected the form values in the URL, but got %q", p.PaymentURL())
+				}
+			} else if len(q) != 0 {
+				t.Fatalf("expected no form values in the URL, but got %q", p.PaymentURL())
+			}
+		})
+	}
+
+	if _, err := api.NewPaymentRequest(10, "test", 1, WithFormMethod("PUT")); err == nil {
+		t.Fatal("expected an error for an unsupported method, but got nil")
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The description makes the base64 contain characters which have to be escaped
+	p, err := api.NewPaymentRequest(10, "тест???>>>", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := p.RedirectURL(); err == nil {
+		t.Fatal("expected to fail without a checksum, but got no error")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	raw, err := p.RedirectURL()
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := p.URL(); u.Scheme+"://"+u.Host+u.Path != expected {
+		t.Fatalf("expected the URL to start with %q, but got %q", expected, raw)
+	}
+
+	q := u.Query()
+	if !strings.ContainsAny(p.Encoded(), "+/") {
+		t.Fatalf("expected the encoded data to contain characters which need escaping, but got %q", p.Encoded())
+	}
+	if q.Get("ENCODED") != p.Encoded() {
+		t.Fatalf("expected ENCODED to be %q, but got %q", p.Encoded(), q.Get("ENCODED"))
+	}
+	if q.Get("CHECKSUM") != p.Checksum() {
+		t.Fatalf("expected CHECKSUM to be %q, but got %q", p.Checksum(), q.Get("CHECKSUM"))
+	}
+	if q.Get("PAGE") != p.Page() {
+		t.Fatalf("expected PAGE to be %q, but got %q", p.Page(), q.Get("PAGE"))
+	}
+
+	d, err := base64.StdEncoding.DecodeString(q.Get("ENCODED"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if !strings.Contains(string(d), "\nDESCR=тест???>>>\n") {
+		t.Fatalf("expected the description in the decoded payload, but got %q", d)
+	}
+}
+
+func TestParsePaymentURL(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithFormMethod(http.MethodGet), WithLanguage(Bulgarian))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.CalcChecksum("test"); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	fields, err := ParsePaymentURL(p.PaymentURL())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	expected := map[string]string{
+		"PAGE":     p.Page(),
+		"ENCODED":  p.Encoded(),
+		"CHECKSUM": p.Checksum(),
+		"LANG":     "bg",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected fields to be %v, but got %v", expected, fields)
+	}
+
+	if _, err := ParsePaymentURL(ePayURL + "?PAGE=paylogin"); err == nil {
+		t.Fatal("expected an error for an URL without ENCODED and CHECKSUM, but got nil")
+	}
+}
+
+func TestCallbackTransactionID(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var got Payment
+	f := func(ctx context.Context, p Payment) error {
+		got = p
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", "INVOICE=123\nSTATUS=PAID\nSTAN=456\nTRANSACTION_ID=TX-789"))
+
+	if expected := "INVOICE=123:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if got.Stan != 456 {
+		t.Fatalf("expected stan to be %d, but got %d", 456, got.Stan)
+	}
+
+	if expected := "TX-789"; got.TransactionID != expected {
+		t.Fatalf("expected transaction ID to be %q, but got %q", expected, got.TransactionID)
+	}
+}
+
+// order is the transaction type of the application in TestWithTransactionMapper
+type order struct {
+	id   string
+	paid bool
+}
+
+// orderMapper maps payments onto orders
+type orderMapper struct{}
+
+func (orderMapper) MapTransaction(p Payment) (any, error) {
+	if p.Invoice == 0 {
+		return nil, errors.New("no order for invoice 0")
+	}
+	return &order{id: fmt.Sprintf("order-%d", p.Invoice), paid: p.Status == "PAID"}, nil
+}
+
+func TestWithTransactionMapper(t *testing.T) {
+	api, err := New("cin", "test", WithTransactionMapper(orderMapper{}))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var got Payment
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		got = p
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=123:STATUS=PAID:STAN=456"))
+	if expected := "INVOICE=123:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	o, ok := got.Transaction.(*order)
+	if !ok {
+		t.Fatalf("expected transaction to be an *order, but got %T", got.Transaction)
+	}
+	if expected := (order{id: "order-123", paid: true}); *o != expected {
+		t.Fatalf("expected transaction to be %+v, but got %+v", expected, *o)
+	}
+
+	// The raw payment is still available
+	if got.Invoice != 123 || got.Stan != 456 {
+		t.Fatalf("expected invoice 123 with stan 456, but got %+v", got)
+	}
+
+	// Mapping errors are answered with ERR
+	w = httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=0:STATUS=PAID"))
+	if expected := "INVOICE=0:STATUS=ERR\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if _, err := New("cin", "test", WithTransactionMapper(nil)); err == nil {
+		t.Fatal("expected to fail for a nil mapper, but got no error")
+	}
+}
+
+func TestWithStatusTransitionValidator(t *testing.T) {
+	// Invoice 2 has expired in the system of the merchant, so it can't be paid anymore
+	states := map[uint64]PaymentStatus{1: "", 2: Expired}
+	validator := func(invoice uint64, newStatus PaymentStatus) error {
+		if states[invoice] == Expired && newStatus == Paid {
+			return fmt.Errorf("invoice %d has expired", invoice)
+		}
+		return nil
+	}
+
+	api, err := New("cin", "test", WithStatusTransitionValidator(validator))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var handled []uint64
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		handled = append(handled, p.Invoice)
+		return nil
+	})
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"allowed", "INVOICE=1:STATUS=PAID", "INVOICE=1:STATUS=OK\n"},
+		{"disallowed", "INVOICE=2:STATUS=PAID", "INVOICE=2:STATUS=NO\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h(w, newCallbackRequest("test", tt.data))
+			if w.Body.String() != tt.expected {
+				t.Fatalf("expected answer to be %q, but got %q", tt.expected, w.Body.String())
+			}
+		})
+	}
+
+	// The rejected payment isn't passed to the handler
+	if expected := []uint64{1}; !reflect.DeepEqual(handled, expected) {
+		t.Fatalf("expected the handler to be called for %v, but got %v", expected, handled)
+	}
+
+	if _, err := New("cin", "test", WithStatusTransitionValidator(nil)); err == nil {
+		t.Fatal("expected to fail for a nil validator, but got no error")
+	}
+}
+
+func TestWithCallbackConsistencyCheck(t *testing.T) {
+	// The payment requests as stored by the merchant
+	requests := map[uint64]struct {
+		amount   float64
+		currency Currency
+	}{
+		1: {19.99, EUR},
+		2: {19.99, EUR},
+		3: {19.99, EUR},
+	}
+	lookup := func(ctx context.Context, invoice uint64) (float64, Currency, error) {
+		r, ok := requests[invoice]
+		if !ok {
+			return 0, "", fmt.Errorf("database unavailable")
+		}
+		return r.amount, r.currency, nil
+	}
+
+	api, err := New("cin", "test", WithCallbackConsistencyCheck(lookup))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var handled []uint64
+	f := func(ctx context.Context, p Payment) error {
+		handled = append(handled, p.Invoice)
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"match", "INVOICE=1:STATUS=PAID:AMOUNT=19.99:CURRENCY=EUR", "INVOICE=1:STATUS=OK\n"},
+		{"currency mismatch", "INVOICE=2:STATUS=PAID:AMOUNT=19.99:CURRENCY=BGN", "INVOICE=2:STATUS=NO\n"},
+		{"amount mismatch", "INVOICE=3:STATUS=PAID:AMOUNT=1.99:CURRENCY=EUR", "INVOICE=3:STATUS=NO\n"},
+		{"lookup error", "INVOICE=4:STATUS=PAID:AMOUNT=19.99:CURRENCY=EUR", "INVOICE=4:STATUS=ERR\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := api.ProcessCallback(newCallbackRequest("test", tt.data), f)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if got := res.String(); got != tt.expected {
+				t.Fatalf("expected answer to be %q, but got %q", tt.expected, got)
+			}
+
+			if res[0].Status == "NO" && !errors.Is(res[0].Err, ErrInconsistentCallback) {
+				t.Fatalf("expected %v to match ErrInconsistentCallback", res[0].Err)
+			}
+		})
+	}
+
+	// Only consistent payments are passed to the handler
+	if expected := []uint64{1}; !reflect.DeepEqual(handled, expected) {
+		t.Fatalf("expected the handler to be called for %v, but got %v", expected, handled)
+	}
+
+	if _, err := New("cin", "test", WithCallbackConsistencyCheck(nil)); err == nil {
+		t.Fatal("expected to fail for a nil lookup, but got no error")
+	}
+}
+
+func TestWithMaxCallbackAge(t *testing.T) {
+	// The clock is frozen, so the age of the callbacks doesn't depend on when the test runs
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, sofia)
+	api, err := New("cin", "test", WithMaxCallbackAge(time.Hour), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	f := func(ctx context.Context, p Payment) error { return nil }
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"fresh", "INVOICE=1:STATUS=PAID:PAY_TIME=20240101113000", "INVOICE=1:STATUS=OK\n"},
+		{"at the limit", "INVOICE=2:STATUS=PAID:PAY_TIME=20240101110000", "INVOICE=2:STATUS=OK\n"},
+		{"stale", "INVOICE=3:STATUS=PAID:PAY_TIME=20240101105959", "INVOICE=3:STATUS=NO\n"},
+		{"no pay time", "INVOICE=4:STATUS=PAID", "INVOICE=4:STATUS=OK\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := api.ProcessCallback(newCallbackRequest("test", tt.data), f)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if got := res.String(); got != tt.expected {
+				t.Fatalf("expected answer to be %q, but got %q", tt.expected, got)
+			}
+
+			if res[0].Status == "NO" && !errors.Is(res[0].Err, ErrStaleCallback) {
+				t.Fatalf("expected %v to match ErrStaleCallback", res[0].Err)
+			}
+		})
+	}
+
+	if _, err := New("cin", "test", WithMaxCallbackAge(0)); err == nil {
+		t.Fatal("expected to fail for a zero age, but got no error")
+	}
+}
+
+func TestMalformedCallback(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var calls int
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		calls++
+		return nil
+	})
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"status without value", "INVOICE=1\nSTATUS", "INVOICE=1:STATUS=ERR\n"},
+		{"status without value on the same line", "INVOICE=1:STATUS", "INVOICE=0:STATUS=ERR\n"},
+		{"invoice without value", "INVOICE\nSTATUS=PAID", "INVOICE=0:STATUS=ERR\n"},
+		{"unknown field without value", "INVOICE=2:STATUS=PAID\nGARBAGE", "INVOICE=2:STATUS=ERR\n"},
+		{"only separators", ":::", "INVOICE=0:STATUS=ERR\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h(w, newCallbackRequest("test", tt.data))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, but got %d", http.StatusOK, w.Code)
+			}
+
+			if w.Body.String() != tt.expected {
+				t.Fatalf("expected answer to be %q, but got %q", tt.expected, w.Body.String())
+			}
+		})
+	}
+
+	if calls != 0 {
+		t.Fatalf("expected the handler not to be called, but it was called %d times", calls)
+	}
+}
+
+func TestCallbackHandlerRecoversPanic(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		panic("handler failure")
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID"))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, but got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestCallbackHandlerWithTimeoutRecoversPanic(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	h := api.CallbackHandlerWithTimeout(time.Second, func(ctx context.Context, p Payment) error {
+		panic("handler failure")
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=ERR\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
+
+func TestPaymentCallbackHandlerWrappedInvalidInvoice(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		return fmt.Errorf("invoice %d: %w", p.Invoice, ErrInvalidInvoice)
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=NO\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
+
+func TestPaymentCallbackHandlerWithInterceptor(t *testing.T) {
+	api, err := New("cin", "test", WithStatusTransitionValidator(func(invoice uint64, status PaymentStatus) error {
+		if invoice == 2 {
+			return fmt.Errorf("invoice %d is expired", invoice)
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The interceptor sees every payment, including the ones rejected before the handler is called
+	var intercepted []CallbackResult
+	h := api.PaymentCallbackHandlerWithInterceptor(func(ctx context.Context, p Payment) error {
+		return nil
+	}, func(ctx context.Context, process func(context.Context) CallbackResult) CallbackResult {
+		res := process(ctx)
+		intercepted = append(intercepted, res)
+		return res
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID\nINVOICE=2:STATUS=DENIED"))
+	if expected := "INVOICE=1:STATUS=OK\nINVOICE=2:STATUS=NO\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if len(intercepted) != 2 {
+		t.Fatalf("expected 2 intercepted payments, but got %d", len(intercepted))
+	}
+	if intercepted[1].Status != "NO" || intercepted[1].Payment.Status != Denied {
+		t.Fatalf("expected the rejected payment to be intercepted, but got %+v", intercepted[1])
+	}
+}
+
+func TestWithMaxBatchSize(t *testing.T) {
+	api, err := New("cin", "test", WithMaxBatchSize(2))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var calls int
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		calls++
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID\nINVOICE=2:STATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=OK\nINVOICE=2:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	// None of the invoices of an over-limit batch is processed
+	w = httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=3:STATUS=PAID\nINVOICE=4:STATUS=PAID\nINVOICE=5:STATUS=PAID"))
+	if expected := "INVOICE=3:STATUS=ERR\nINVOICE=4:STATUS=ERR\nINVOICE=5:STATUS=ERR\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if expected := 2; calls != expected {
+		t.Fatalf("expected the handler to be called %d times, but got %d", expected, calls)
+	}
+
+	if _, err := New("cin", "test", WithMaxBatchSize(0)); err == nil {
+		t.Fatal("expected to fail for a zero batch size, but got no error")
+	}
+}
+
+func TestWithAnswerContentType(t *testing.T) {
+	f := func(ctx context.Context, p Payment) error { return nil }
+
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID"))
+
+	if expected := "text/plain; charset=utf-8"; w.Header().Get("Content-Type") != expected {
+		t.Fatalf("expected content type to be %q, but got %q", expected, w.Header().Get("Content-Type"))
+	}
+
+	api, err = New("cin", "test", WithAnswerContentType("text/plain"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID"))
+
+	if expected := "text/plain"; w.Header().Get("Content-Type") != expected {
+		t.Fatalf("expected content type to be %q, but got %q", expected, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestCallbackEmptySecret(t *testing.T) {
+	api, err := New("cin", "")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	called := false
+	f := func(ctx context.Context, p Payment) error {
+		called = true
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("", "INVOICE=1\nSTATUS=PAID"))
+
+	if expected := "INVOICE=0:STATUS=ERR\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if called {
+		t.Fatal("expected the payment handler not to be called")
+	}
+
+	if api.Verify("data", api.Sign("data")) {
+		t.Fatal("expected verification to fail with an empty secret")
+	}
+}
+
+func TestWithDebug(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	f := func(ctx context.Context, p Payment) error { return nil }
+	r := newCallbackRequest("wrong", "INVOICE=1\nSTATUS=PAID")
+	encoded := r.FormValue("encoded")
+
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	api.PaymentCallbackHandler(f)(httptest.NewRecorder(), r)
+	if strings.Contains(buf.String(), "debug:") {
+		t.Fatalf("expected no debug log without WithDebug, but got %q", buf.String())
+	}
+
+	api, err = New("cin", "test", WithDebug())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	buf.Reset()
+	api.PaymentCallbackHandler(f)(httptest.NewRecorder(), newCallbackRequest("wrong", "INVOICE=1\nSTATUS=PAID"))
+	if !strings.Contains(buf.String(), "debug:") || !strings.Contains(buf.String(), encoded) {
+		t.Fatalf("expected a debug log with the encoded data, but got %q", buf.String())
+	}
+
+	if strings.Contains(buf.String(), `"test"`) {
+		t.Fatalf("expected the secret not to be logged, but got %q", buf.String())
+	}
+
+	// Neither must the valid checksum of the received data, it would turn the log into a signing oracle
+	if valid := Checksum("test", encoded); strings.Contains(buf.String(), valid) {
+		t.Fatalf("expected the valid checksum not to be logged, but got %q", buf.String())
+	}
+}
+
+// capturingLogger records the messages logged through it
+type capturingLogger struct {
+	messages []string
+}
+
+func (l *capturingLogger) Printf(format string, v ...any) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	l := &capturingLogger{}
+	api, err := New("cin", "test", WithLogger(l))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	r := newCallbackRequest("wrong", "INVOICE=1:STATUS=PAID")
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if len(l.messages) != 1 || !strings.Contains(l.messages[0], "invalid checksum") {
+		t.Fatalf("expected the checksum mismatch to be logged, but got %q", l.messages)
+	}
+
+	// The valid checksum of the received data mustn't leak into the log
+	if valid := Checksum("test", r.FormValue("encoded")); strings.Contains(l.messages[0], valid) {
+		t.Fatalf("expected the valid checksum not to be logged, but got %q", l.messages[0])
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing to be logged to the standard logger, but got %q", buf.String())
+	}
+
+	if _, err := New("cin", "test", WithLogger(nil)); err == nil {
+		t.Fatal("expected to fail for a nil logger, but got no error")
+	}
+}
+
+func TestWithMerchantName(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithMerchantName("Магазин Пример"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "MERCHANT_NAME=Магазин Пример\n"; !strings.Contains(string(d), expected) {
+		t.Fatalf("expected encoded data to contain %q, but got %q", expected, d)
+	}
+
+	if _, err := api.NewPaymentRequest(10, "test", 1, WithMerchantName(strings.Repeat("x", maxMerchantNameLength+1))); err == nil {
+		t.Fatal("expected an error for a too long merchant name, but got nil")
+	}
+}
+
+func TestEncodeLoginPage(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithPage(Login))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err = api.NewPaymentRequest(10, "", 1, WithPage(Login))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err == nil {
+		t.Fatal("expected an error for a login request without description, but got nil")
+	}
+}
+
+func TestPaymentRequestHandlerCacheHeaders(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test&invoice=1", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	expected := map[string]string{
+		"Cache-Control": "no-store, no-cache, must-revalidate",
+		"Pragma":        "no-cache",
+		"Expires":       "0",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Fatalf("expected header %s to be %q, but got %q", name, value, got)
+		}
+	}
+}
+
+func TestPaymentRequestHandlerInvalid(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"invalid option", "amount=10&description=test&invoice=1&language=de"},
+		{"invalid amount", "amount=1000000&description=test&invoice=1"},
+		{"invalid invoice", "amount=10&description=test&invoice=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?"+tt.query, nil))
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("expected status %d, but got %d: %s", http.StatusInternalServerError, w.Code, w.Body.String())
+			}
+
+			if strings.Contains(w.Body.String(), "<form") {
+				t.Fatalf("expected no payment form, but got %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPaymentRequestHandlerExpired(t *testing.T) {
+	// The clock jumps past the default expiration after the payment request has been created
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	clock := func() time.Time {
+		calls++
+		if calls == 1 {
+			return start
+		}
+		return start.AddDate(0, 0, 8)
+	}
+
+	api, err := New("cin", "test", WithClock(clock))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test&invoice=1", nil))
+
+	if w.Code != http.StatusGone {
+		t.Fatalf("expected status %d, but got %d", http.StatusGone, w.Code)
+	}
+
+	expired := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "custom expired page", http.StatusGone)
+	})
+
+	calls = 0
+	api, err = New("cin", "test", WithClock(clock), WithExpiredHandler(expired))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test&invoice=1", nil))
+
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "custom expired page") {
+		t.Fatalf("expected the expired handler to be called, but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPaymentRequestHandlerExpTime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		expTime  string
+		expected int
+	}{
+		{"past", now.Add(-time.Minute).Format(time.RFC3339), http.StatusGone},
+		{"past in epay format", "01.01.2024 13:59:00", http.StatusGone},
+		{"future", now.Add(time.Hour).Format(time.RFC3339), http.StatusOK},
+		{"future in epay format", "01.01.2024 15:00:00", http.StatusOK},
+		{"invalid", "tomorrow", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"amount": {"10"}, "description": {"test"}, "invoice": {"1"}, "exp_time": {tt.expTime}}
+			w := httptest.NewRecorder()
+			api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?"+query.Encode(), nil))
+
+			if w.Code != tt.expected {
+				t.Fatalf("expected status %d, but got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRetrySchedule(t *testing.T) {
+	schedule := RetrySchedule()
+	if len(schedule) == 0 {
+		t.Fatal("expected a non-empty schedule")
+	}
+
+	for i := 1; i < len(schedule); i++ {
+		if schedule[i] <= schedule[i-1] {
+			t.Fatalf("expected the schedule to be increasing, but %v follows %v", schedule[i], schedule[i-1])
+		}
+	}
+
+	schedule[0] = 0
+	if RetrySchedule()[0] == 0 {
+		t.Fatal("expected the schedule not to be modifiable")
+	}
+}
+
+func TestPaymentStatusFromString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected PaymentStatus
+		err      bool
+	}{
+		{"PAID", Paid, false},
+		{"DENIED", Denied, false},
+		{"EXPIRED", Expired, false},
+		{"paid", Paid, false},
+		{" Expired ", Expired, false},
+		{"REFUNDED", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := PaymentStatusFromString(tt.input)
+			if tt.err {
+				if !errors.Is(err, ErrUnknownStatus) {
+					t.Fatalf("expected ErrUnknownStatus, but got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected %q, but got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCallbackUnknownStatus(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var got []Payment
+	f := func(ctx context.Context, p Payment) error {
+		got = append(got, p)
+		return nil
+	}
+
+	res, err := api.ProcessCallback(newCallbackRequest("test", "INVOICE=1:STATUS=paid\nINVOICE=2:STATUS=REFUNDED"), f)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "INVOICE=1:STATUS=OK\nINVOICE=2:STATUS=ERR\n"; res.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, res.String())
+	}
+
+	if !errors.Is(res[1].Err, ErrUnknownStatus) {
+		t.Fatalf("expected %v to match ErrUnknownStatus", res[1].Err)
+	}
+
+	// The case of the status is normalized and the payment with the unknown status isn't handled
+	if len(got) != 1 || got[0].Status != Paid {
+		t.Fatalf("expected only the paid payment to be handled, but got %+v", got)
+	}
+}
+
+func TestWithStrictCallbackParsing(t *testing.T) {
+	f := func(ctx context.Context, p Payment) error { return nil }
+
+	tests := []struct {
+		name    string
+		data    string
+		lenient string
+		strict  string
+	}{
+		{"known", "INVOICE=1\nSTATUS=PAID\n", "OK", "OK"},
+		{"unknown field", "INVOICE=1\nSTATUS=PAID\nNEW_FIELD=x", "OK", "ERR"},
+		{"unknown status", "INVOICE=1\nSTATUS=REFUNDED", "ERR", "ERR"},
+	}
+
+	lenient, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	strict, err := New("cin", "test", WithStrictCallbackParsing())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			lenient.PaymentCallbackHandler(f)(w, newCallbackRequest("test", tt.data))
+			if expected := "INVOICE=1:STATUS=" + tt.lenient + "\n"; w.Body.String() != expected {
+				t.Fatalf("expected lenient answer to be %q, but got %q", expected, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			strict.PaymentCallbackHandler(f)(w, newCallbackRequest("test", tt.data))
+			if expected := "INVOICE=1:STATUS=" + tt.strict + "\n"; w.Body.String() != expected {
+				t.Fatalf("expected strict answer to be %q, but got %q", expected, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithRawCallbackObserver(t *testing.T) {
+	var gotEncoded, gotDecoded, gotChecksum string
+	observer := func(encoded, decoded, checksum string) {
+		gotEncoded, gotDecoded, gotChecksum = encoded, decoded, checksum
+	}
+
+	api, err := New("cin", "test", WithRawCallbackObserver(observer))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	data := "INVOICE=1\nSTATUS=PAID\n"
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, newCallbackRequest("test", data))
+
+	if gotDecoded != data {
+		t.Fatalf("expected decoded data to be %q, but got %q", data, gotDecoded)
+	}
+
+	if expected := base64.StdEncoding.EncodeToString([]byte(data)); gotEncoded != expected {
+		t.Fatalf("expected encoded data to be %q, but got %q", expected, gotEncoded)
+	}
+
+	if expected := api.Sign(gotEncoded); gotChecksum != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, gotChecksum)
+	}
+
+	// Callbacks which fail verification mustn't reach the observer
+	gotDecoded = ""
+	w = httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, newCallbackRequest("wrong", data))
+	if gotDecoded != "" {
+		t.Fatalf("expected observer not to be called for an invalid checksum, but got %q", gotDecoded)
+	}
+}
+
+func TestParseCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    any
+		expected Currency
+		err      bool
+	}{
+		{"alpha", "EUR", EUR, false},
+		{"alpha lowercase", "bgn", BGN, false},
+		{"currency", USD, USD, false},
+		{"numeric", 978, EUR, false},
+		{"numeric uint64", uint64(975), BGN, false},
+		{"numeric string", "840", USD, false},
+		{"numeric string with spaces", " 978 ", EUR, false},
+		{"unknown alpha", "GBP", "", true},
+		{"unknown numeric", 826, "", true},
+		{"unknown numeric string", "826", "", true},
+		{"negative", -978, "", true},
+		{"unsupported type", 978.0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			curr, err := ParseCurrency(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected to fail, but got %q", curr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if curr != tt.expected {
+				t.Fatalf("expected currency to be %q, but got %q", tt.expected, curr)
+			}
+		})
+	}
+}
+
+func TestWithCINInAnswer(t *testing.T) {
+	f := func(ctx context.Context, p Payment) error { return nil }
+	data := "INVOICE=1\nSTATUS=PAID\n"
+
+	api, err := New("123", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", data))
+	if expected := "INVOICE=1:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	api, err = New("123", "test", WithCINInAnswer())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", data))
+	if expected := "INVOICE=1:STATUS=OK:MIN=123\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
+
+func TestEncodeMaxExpirationWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		options []Option
+		exp     time.Time
+		err     bool
+	}{
+		{"default at boundary", nil, now.Add(30 * 24 * time.Hour), false},
+		{"default beyond boundary", nil, now.Add(30*24*time.Hour + time.Second), true},
+		{"custom at boundary", []Option{WithMaxExpirationWindow(time.Hour)}, now.Add(time.Hour), false},
+		{"custom beyond boundary", []Option{WithMaxExpirationWindow(time.Hour)}, now.Add(time.Hour + time.Second), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := New("cin", "test", append(tt.options, WithClock(clock))...)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			p, err := api.NewPaymentRequest(10, "test", 1, WithExpirationTime(tt.exp))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			err = p.encode()
+			if tt.err && err == nil {
+				t.Fatal("expected to fail, but got no error")
+			}
+			if !tt.err && err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+		})
+	}
+
+	if _, err := New("cin", "test", WithMaxExpirationWindow(0)); err == nil {
+		t.Fatal("expected to fail for a zero window, but got no error")
+	}
+}
+
+func TestMarshalForm(t *testing.T) {
+	api, err := New("123", "test", WithDefaultURLOk("https://example.com/ok"), WithDefaultURLCancel("https://example.com/cancel"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := p.MarshalForm(); err == nil {
+		t.Fatal("expected to fail for an unprepared payment request, but got no error")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	v, err := p.MarshalForm()
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	expected := map[string]string{
+		"PAGE":       p.Page(),
+		"ENCODED":    p.Encoded(),
+		"CHECKSUM":   p.Checksum(),
+		"LANG":       "en",
+		"URL_OK":     "https://example.com/ok",
+		"URL_CANCEL": "https://example.com/cancel",
+	}
+	if len(v) != len(expected) {
+		t.Fatalf("expected %d fields, but got %v", len(expected), v)
+	}
+	for name, value := range expected {
+		if got := v.Get(name); got != value {
+			t.Fatalf("expected %s to be %q, but got %q", name, value, got)
+		}
+	}
+
+	// The CIN is sent as part of the signed data
+	d, err := base64.StdEncoding.DecodeString(v.Get("ENCODED"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if !strings.Contains(string(d), "MIN=123\n") {
+		t.Fatalf("expected the encoded data to contain the CIN, but got %q", d)
+	}
+
+	if expected := api.Sign(v.Get("ENCODED")); v.Get("CHECKSUM") != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, v.Get("CHECKSUM"))
+	}
+
+	// The payment form is rendered from the same fields
+	w := httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test&invoice=1", nil))
+	for _, name := range []string{"PAGE", "ENCODED", "CHECKSUM", "LANG"} {
+		if !strings.Contains(w.Body.String(), `name="`+name+`"`) {
+			t.Fatalf("expected the payment form to contain %s", name)
+		}
+	}
+}
+
+func TestEncodeDescription(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "Order 42", 1, WithLanguage(Bulgarian))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	data := string(d)
+
+	if !strings.Contains(data, "DESCR=Order 42\n") {
+		t.Fatalf("expected the encoded data to contain the description, but got %q", data)
+	}
+
+	if expected := 1; strings.Count(data, "LANGUAGE=") != expected {
+		t.Fatalf("expected the language to be encoded %d time, but got %q", expected, data)
+	}
+
+	if !strings.Contains(data, "LANGUAGE=bg\n") {
+		t.Fatalf("expected the encoded data to contain the language, but got %q", data)
+	}
+}
+
+func TestDescriptionLineBreaks(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, description := range []string{"Order 42\nINVOICE=43", "Order 42\rINVOICE=43", "Order 42\r\n"} {
+		p, err := api.NewPaymentRequest(10, description, 1)
+		if err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+
+		if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "line breaks") {
+			t.Fatalf("expected description %q to be rejected, but got %v", description, err)
+		}
+
+		if err := p.encode(); err == nil {
+			t.Fatalf("expected description %q not to be encoded", description)
+		}
+	}
+
+	// The payment request handler takes the description from a form
+	query := url.Values{"invoice": {"1"}, "amount": {"10"}, "description": {"Order 42\nINVOICE=43"}}
+	w := httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?"+query.Encode(), nil))
+	if w.Code == http.StatusOK {
+		t.Fatalf("expected the payment request to be rejected, but got %q", w.Body.String())
+	}
+}
+
+func TestCallbackGzip(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("INVOICE=1\nSTATUS=PAID\n"))
+	form := url.Values{}
+	form.Set("encoded", encoded)
+	form.Set("checksum", api.Sign(encoded))
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte(form.Encode()))
+	zw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/callback", &body)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Content-Encoding", "gzip")
+
+	var got Payment
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		got = p
+		return nil
+	})(w, r)
+
+	if expected := "INVOICE=1:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if got.Invoice != 1 || got.Status != Paid {
+		t.Fatalf("expected the payment to be parsed, but got %+v", got)
+	}
+
+	// A body which isn't gzipped is rejected
+	r = newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID\n")
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, r)
+	if expected := http.StatusBadRequest; w.Code != expected {
+		t.Fatalf("expected status code to be %d, but got %d", expected, w.Code)
+	}
+}
+
+func TestWithURLOkAndCancel(t *testing.T) {
+	api, err := New("cin", "test", WithDefaultURLOk("https://example.com/default"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithURLOk("https://example.com/ok"), WithURLCancel("https://example.com/cancel"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, expected := range []string{"URL_OK=https://example.com/ok\n", "URL_CANCEL=https://example.com/cancel\n"} {
+		if !strings.Contains(string(d), expected) {
+			t.Fatalf("expected the encoded data to contain %q, but got %q", expected, d)
+		}
+	}
+
+	// The URLs are part of the signed data
+	if expected := api.Sign(p.Encoded()); p.Checksum() != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, p.Checksum())
+	}
+
+	// The lines are left out when the URLs aren't set
+	p, err = api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	p.URLOk = ""
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	d, _ = base64.StdEncoding.DecodeString(p.Encoded())
+	if strings.Contains(string(d), "URL_") {
+		t.Fatalf("expected the encoded data not to contain URLs, but got %q", d)
+	}
+
+	for _, option := range []PaymentOption{WithURLOk("/relative"), WithURLCancel("ftp://example.com")} {
+		if _, err := api.NewPaymentRequest(10, "test", 1, option); err == nil {
+			t.Fatal("expected to fail for an invalid URL, but got no error")
+		}
+	}
+}
+
+func TestWithMaxClockSkew(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		skew    time.Duration
+		exp     time.Time
+		expired bool
+	}{
+		{"no skew at boundary", 0, now, true},
+		{"no skew before boundary", 0, now.Add(time.Second), false},
+		{"within skew", 5 * time.Second, now.Add(-4 * time.Second), false},
+		{"at skew boundary", 5 * time.Second, now.Add(-5 * time.Second), true},
+		{"beyond skew", 5 * time.Second, now.Add(-6 * time.Second), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := New("cin", "test", WithClock(clock), WithMaxClockSkew(tt.skew))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			p, err := api.NewPaymentRequest(10, "test", 1, WithExpirationTime(tt.exp))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if p.Expired() != tt.expired {
+				t.Fatalf("expected expired to be %v, but got %v", tt.expired, p.Expired())
+			}
+
+			// Validate tolerates the same skew
+			if err := p.Validate(); errors.Is(err, ErrInvalidExpiration) != tt.expired {
+				t.Fatalf("expected the expiration to be invalid %v, but got %v", tt.expired, err)
+			}
+		})
+	}
+
+	if _, err := New("cin", "test", WithMaxClockSkew(-time.Second)); err == nil {
+		t.Fatal("expected to fail for a negative skew, but got no error")
+	}
+}
+
+func TestLanguageFromString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Language
+		err      bool
+	}{
+		{"english", English, false},
+		{"eng", English, false},
+		{"en", English, false},
+		{"English", English, false},
+		{" EN ", English, false},
+		{"български", Bulgarian, false},
+		{"Български", Bulgarian, false},
+		{"бг", Bulgarian, false},
+		{"bulgarian", Bulgarian, false},
+		{"bul", Bulgarian, false},
+		{"bg", Bulgarian, false},
+		{"\tBG\n", Bulgarian, false},
+		{"de", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			lang, err := LanguageFromString(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected to fail, but got %q", lang)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if lang != tt.expected {
+				t.Fatalf("expected language to be %q, but got %q", tt.expected, lang)
+			}
+		})
+	}
+}
+
+func TestCurrencyFromString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Currency
+		err      bool
+	}{
+		{"euro", EUR, false},
+		{"eur", EUR, false},
+		{"Euro", EUR, false},
+		{" EUR ", EUR, false},
+		{"lev", BGN, false},
+		{"лев", BGN, false},
+		{"Лев", BGN, false},
+		{"bgn", BGN, false},
+		{"\tBGN\n", BGN, false},
+		{"usd", USD, false},
+		{"USD", USD, false},
+		{"gbp", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			curr, err := CurrencyFromString(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected to fail, but got %q", curr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if curr != tt.expected {
+				t.Fatalf("expected currency to be %q, but got %q", tt.expected, curr)
+			}
+		})
+	}
+}
+
+func TestCallbackChecksumComparison(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("INVOICE=1\nSTATUS=PAID\n"))
+	tampered := base64.StdEncoding.EncodeToString([]byte("INVOICE=2\nSTATUS=PAID\n"))
+
+	tests := []struct {
+		name     string
+		encoded  string
+		checksum string
+		code     int
+	}{
+		{"signed", encoded, api.Sign(encoded), http.StatusOK},
+		{"upper case", encoded, strings.ToUpper(api.Sign(encoded)), http.StatusOK},
+		{"tampered", tampered, api.Sign(encoded), http.StatusBadRequest},
+		{"not hex", encoded, "not hex", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Set("encoded", tt.encoded)
+			form.Set("checksum", tt.checksum)
+			r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("expected status code to be %d, but got %d", tt.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestCallbackMultipleInvoices(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	data := "INVOICE=123:STATUS=PAID:PAY_TIME=20240101120000:STAN=1:BCODE=A1\nINVOICE=124:STATUS=DENIED:PAY_TIME=01.01.2024 12:30:00\n"
+
+	var payments []Payment
+	f := func(ctx context.Context, p Payment) error {
+		payments = append(payments, p)
+		if p.Invoice == 124 {
+			return ErrInvalidInvoice
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("test", data))
+	if expected := "INVOICE=123:STATUS=OK\nINVOICE=124:STATUS=NO\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if expected := 2; len(payments) != expected {
+		t.Fatalf("expected the handler to be called %d times, but got %d", expected, len(payments))
+	}
+
+	expected := Payment{Invoice: 123, Status: Paid, PayDate: time.Date(2024, 1, 1, 12, 0, 0, 0, sofia), Stan: 1, Bcode: "A1"}
+	if !reflect.DeepEqual(payments[0], expected) {
+		t.Fatalf("expected first payment to be %+v, but got %+v", expected, payments[0])
+	}
+
+	expected = Payment{Invoice: 124, Status: Denied, PayDate: time.Date(2024, 1, 1, 12, 30, 0, 0, sofia)}
+	if !reflect.DeepEqual(payments[1], expected) {
+		t.Fatalf("expected second payment to be %+v, but got %+v", expected, payments[1])
+	}
+
+	// A parse error only affects its own invoice
+	w = httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID:STAN=x\nINVOICE=2:STATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=ERR\nINVOICE=2:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
+
+func TestParseCallback(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("INVOICE=1:STATUS=PAID\nINVOICE=2:STATUS=DENIED\n"))
+	payments, err := api.ParseCallback(encoded, api.Sign(encoded))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	expected := []Payment{{Invoice: 1, Status: Paid}, {Invoice: 2, Status: Denied}}
+	if !reflect.DeepEqual(payments, expected) {
+		t.Fatalf("expected payments to be %+v, but got %+v", expected, payments)
+	}
+
+	if _, err := api.ParseCallback(encoded, Checksum("wrong", encoded)); !errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("expected ErrInvalidChecksum, but got %v", err)
+	}
+
+	malformed := "not base64!"
+	if _, err := api.ParseCallback(malformed, api.Sign(malformed)); err == nil || errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("expected a decoding error, but got %v", err)
+	}
+}
+
+func TestParseCallbackWithKeyID(t *testing.T) {
+	api, err := New("cin", "unused", WithKeySet(map[string]string{"2023": "old", "2024": "new"}), WithKeyID("2024"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("INVOICE=1:STATUS=PAID\n"))
+	expected := []Payment{{Invoice: 1, Status: Paid}}
+
+	// Callbacks signed with the old key are verified with it during the migration
+	for id, secret := range map[string]string{"2023": "old", "2024": "new"} {
+		payments, err := api.ParseCallbackWithKeyID(id, encoded, Checksum(secret, encoded))
+		if err != nil {
+			t.Fatalf("expected key %s to pass, but got %v", id, err)
+		}
+		if !reflect.DeepEqual(payments, expected) {
+			t.Fatalf("expected payments to be %+v, but got %+v", expected, payments)
+		}
+	}
+
+	// Untagged callbacks are verified with the secret of the API, which is the one of the active key ID
+	if _, err := api.ParseCallback(encoded, Checksum("new", encoded)); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if _, err := api.ParseCallback(encoded, Checksum("old", encoded)); !errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("expected ErrInvalidChecksum, but got %v", err)
+	}
+
+	if _, err := api.ParseCallbackWithKeyID("2023", encoded, Checksum("new", encoded)); !errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("expected ErrInvalidChecksum, but got %v", err)
+	}
+
+	if _, err := api.ParseCallbackWithKeyID("2022", encoded, Checksum("old", encoded)); err == nil || errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("expected an unknown key ID error, but got %v", err)
+	}
+}
+
+func TestWithNewline(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, nl := range []string{"\n", "\r\n"} {
+		t.Run(fmt.Sprintf("%q", nl), func(t *testing.T) {
+			p, err := api.NewPaymentRequest(10, "test", 1, WithNewline(nl), WithCharset("utf-8"))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if err := api.Prepare(p); err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			d, err := base64.StdEncoding.DecodeString(p.Encoded())
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+			data := string(d)
+
+			if !strings.HasSuffix(data, "ENCODING=utf-8"+nl) {
+				t.Fatalf("expected the data to end with a separator, but got %q", data)
+			}
+
+			// Every field has to be followed by the separator
+			fields := strings.Split(strings.TrimSuffix(data, nl), nl)
+			if expected := strings.Count(data, "="); len(fields) != expected {
+				t.Fatalf("expected %d fields, but got %q", expected, data)
+			}
+			for _, f := range fields {
+				if strings.ContainsAny(f, "\r\n") {
+					t.Fatalf("expected field %q not to contain another separator", f)
+				}
+			}
+
+			if expected := api.Sign(p.Encoded()); p.Checksum() != expected {
+				t.Fatalf("expected checksum to be %q, but got %q", expected, p.Checksum())
+			}
+		})
+	}
+
+	if _, err := api.NewPaymentRequest(10, "test", 1, WithNewline("\r")); err == nil {
+		t.Fatal("expected to fail for an unsupported newline, but got no error")
+	}
+}
+
+func TestEncodeInvoiceDigits(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		invoice uint64
+		err     bool
+	}{
+		{"at limit", 9999999999, false},
+		{"beyond limit", 10000000000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := api.NewPaymentRequest(10, "test", tt.invoice)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			err = p.encode()
+			if tt.err && err == nil {
+				t.Fatal("expected to fail, but got no error")
+			}
+			if !tt.err && err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/pay?amount=10&description=test&invoice=%d", tt.invoice), nil))
+			if tt.err && w.Code == http.StatusOK {
+				t.Fatal("expected the handler to fail, but got status code 200")
+			}
+			if !tt.err && w.Code != http.StatusOK {
+				t.Fatalf("expected the handler to pass, but got status code %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// countingWriter counts the calls of WriteHeader
+type countingWriter struct {
+	*httptest.ResponseRecorder
+	headers int
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	w.headers++
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestCallbackAnswer(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		handler PaymentHandlerFunc
+		answer  string
+	}{
+		{"ok", "INVOICE=1:STATUS=PAID", func(ctx context.Context, p Payment) error { return nil }, "INVOICE=1:STATUS=OK\n"},
+		{"invalid invoice", "INVOICE=2:STATUS=PAID", func(ctx context.Context, p Payment) error { return ErrInvalidInvoice }, "INVOICE=2:STATUS=NO\n"},
+		{"mixed", "INVOICE=3:STATUS=PAID\nINVOICE=4:STATUS=PAID", func(ctx context.Context, p Payment) error {
+			if p.Invoice == 4 {
+				return ErrInvalidInvoice
+			}
+			return nil
+		}, "INVOICE=3:STATUS=OK\nINVOICE=4:STATUS=NO\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+			api.PaymentCallbackHandler(tt.handler)(w, newCallbackRequest("test", tt.data))
+
+			if expected := 1; w.headers != expected {
+				t.Fatalf("expected the status to be written %d time, but got %d", expected, w.headers)
+			}
+
+			if expected := http.StatusOK; w.Code != expected {
+				t.Fatalf("expected status code to be %d, but got %d", expected, w.Code)
+			}
+
+			if !bytes.Equal(w.Body.Bytes(), []byte(tt.answer)) {
+				t.Fatalf("expected answer to be %q, but got %q", tt.answer, w.Body.Bytes())
+			}
+
+			if expected := fmt.Sprint(len(tt.answer)); w.Header().Get("Content-Length") != expected {
+				t.Fatalf("expected content length to be %s, but got %s", expected, w.Header().Get("Content-Length"))
+			}
+		})
+	}
+
+	// Invalid callbacks are rejected with a single status as well
+	w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, newCallbackRequest("wrong", "INVOICE=1:STATUS=PAID"))
+	if w.headers != 1 || w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a single status 400, but got %d writes with status %d", w.headers, w.Code)
+	}
+}
+
+func TestWithFormTemplate(t *testing.T) {
+	tpl := template.Must(template.New("form").Parse(`<form action="{{ .PaymentURL }}">{{ range $name, $values := .MarshalForm }}{{ $name }}={{ index $values 0 }};{{ end }}</form>`))
+
+	now := time.Now()
+	api, err := New("cin", "test", WithFormTemplate(tpl), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test&invoice=1", nil))
+	if expected := http.StatusOK; w.Code != expected {
+		t.Fatalf("expected status code to be %d, but got %d: %s", expected, w.Code, w.Body.String())
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "<form") {
+		t.Fatalf("expected the custom template to be rendered, but got %q", body)
+	}
+	for _, expected := range []string{"ENCODED=" + p.Encoded() + ";", "CHECKSUM=" + p.Checksum() + ";"} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected the form to contain %q, but got %q", expected, body)
+		}
+	}
+
+	if _, err := New("cin", "test", WithFormTemplate(nil)); err == nil {
+		t.Fatal("expected to fail for a nil template, but got no error")
+	}
+}
+
+func TestBuildAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []CallbackResult
+		expected string
+	}{
+		{"none", nil, ""},
+		{"single", []CallbackResult{{Invoice: 1, Status: "OK"}}, "INVOICE=1:STATUS=OK\n"},
+		{"multiple", []CallbackResult{
+			{Invoice: 1, Status: "OK"},
+			{Invoice: 2, Status: "NO", Err: ErrInvalidInvoice},
+			{Invoice: 3, Status: "ERR", CIN: "123"},
+		}, "INVOICE=1:STATUS=OK\nINVOICE=2:STATUS=NO\nINVOICE=3:STATUS=ERR:MIN=123\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildAnswer(tt.results); got != tt.expected {
+				t.Fatalf("expected answer to be %q, but got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParams(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1, WithExpirationTime(now.Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := p.Params(); err == nil {
+		t.Fatal("expected to fail without a checksum, but got no error")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	params, err := p.Params()
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("MIN=cin\nINVOICE=1\nAMOUNT=10.00\nEXP_TIME=01.01.2024 13:00:00\nCURRENCY=EUR\nLANGUAGE=en\nDESCR=test\n"))
+	h := hmac.New(sha1.New, []byte("test"))
+	h.Write([]byte(encoded))
+
+	expected := map[string]string{
+		"PAGE":     "credit_paydirect",
+		"URL":      ePayURL,
+		"ENCODED":  encoded,
+		"CHECKSUM": hex.EncodeToString(h.Sum(nil)),
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Fatalf("expected params to be %v, but got %v", expected, params)
+	}
+}
+
+func TestButtonHTML(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := p.ButtonHTML("Pay now"); err == nil {
+		t.Fatal("expected to fail without a checksum, but got no error")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	button, err := p.ButtonHTML("Pay now")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	doc, err := html.Parse(strings.NewReader(string(button)))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Collect the hidden fields and the label of the button
+	hidden := map[string]string{}
+	var label string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			attrs := map[string]string{}
+			for _, a := range n.Attr {
+				attrs[a.Key] = a.Val
+			}
+			switch {
+			case n.Data == "input" && attrs["type"] == "hidden":
+				hidden[attrs["name"]] = attrs["value"]
+			case n.Data == "button" && n.FirstChild != nil:
+				label = n.FirstChild.Data
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if expected := "Pay now"; label != expected {
+		t.Fatalf("expected the label to be %q, but got %q", expected, label)
+	}
+
+	fields, err := p.MarshalForm()
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	for name := range fields {
+		if hidden[name] != fields.Get(name) {
+			t.Fatalf("expected hidden field %s to be %q, but got %q", name, fields.Get(name), hidden[name])
+		}
+	}
+}
+
+func TestWriteForm(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteForm(&buf); err == nil {
+		t.Fatal("expected to fail without a checksum, but got no error")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing to be written, but got %q", buf.String())
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := p.WriteForm(&buf); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, expected := range []string{p.Encoded(), p.Checksum(), p.URL()} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("expected the form to contain %q, but got %q", expected, buf.String())
+		}
+	}
+}
+
+func TestWriteFormWithFormTemplate(t *testing.T) {
+	tpl := template.Must(template.New("custom").Parse(`custom {{ .Encoded }}`))
+	api, err := New("cin", "test", WithFormTemplate(tpl))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteForm(&buf); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := "custom " + p.Encoded(); buf.String() != expected {
+		t.Fatalf("expected the form to be %q, but got %q", expected, buf.String())
+	}
+}
+
+func TestGenerateForm(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := p.GenerateForm("Pay"); err == nil {
+		t.Fatal("expected to fail without a checksum, but got no error")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	form, err := p.GenerateForm("Pay")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	doc, err := html.Parse(strings.NewReader(string(form)))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Collect the attributes of the form and its inputs
+	var action string
+	hidden := map[string]string{}
+	var submit string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			attrs := map[string]string{}
+			for _, a := range n.Attr {
+				attrs[a.Key] = a.Val
+			}
+			switch {
+			case n.Data == "form":
+				action = attrs["action"]
+			case n.Data == "input" && attrs["type"] == "hidden":
+				hidden[attrs["name"]] = attrs["value"]
+			case n.Data == "input" && attrs["type"] == "submit":
+				submit = attrs["value"]
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if action != p.URL() {
+		t.Fatalf("expected the form action to be %q, but got %q", p.URL(), action)
+	}
+
+	if submit != "Pay" {
+		t.Fatalf("expected the submit button to be labelled %q, but got %q", "Pay", submit)
+	}
+
+	expected := map[string]string{
+		"PAGE":     p.Page(),
+		"ENCODED":  p.Encoded(),
+		"CHECKSUM": p.Checksum(),
+		"LANG":     "en",
+	}
+	if !reflect.DeepEqual(hidden, expected) {
+		t.Fatalf("expected hidden inputs to be %v, but got %v", expected, hidden)
+	}
+}
+
+func TestWithResponseBuilder(t *testing.T) {
+	builder := func(results []CallbackResult) (int, []byte) {
+		var b strings.Builder
+		for _, res := range results {
+			fmt.Fprintf(&b, "%d=%s;", res.Invoice, res.Status)
+		}
+		return http.StatusAccepted, []byte(b.String())
+	}
+
+	api, err := New("cin", "test", WithResponseBuilder(builder))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID\nINVOICE=2:STATUS=PAID"))
+
+	if expected := http.StatusAccepted; w.Code != expected {
+		t.Fatalf("expected status code to be %d, but got %d", expected, w.Code)
+	}
+
+	if expected := "1=OK;2=OK;"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	if _, err := New("cin", "test", WithResponseBuilder(nil)); err == nil {
+		t.Fatal("expected to fail for a nil builder, but got no error")
+	}
+}
+
+func TestValidatePageCurrency(t *testing.T) {
+	tests := []struct {
+		page     PaymentPage
+		currency Currency
+		valid    bool
+	}{
+		{Login, BGN, true},
+		{Login, EUR, true},
+		{Login, USD, false},
+		{Direct, BGN, true},
+		{Direct, EUR, true},
+		{Direct, USD, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.page)+"/"+string(tt.currency), func(t *testing.T) {
+			p := NewTestPaymentRequest(WithPage(tt.page), WithCurrency(tt.currency))
+			err := p.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrUnsupportedCurrency) {
+				t.Fatalf("expected error to match %q, but got %v", ErrUnsupportedCurrency, err)
+			}
+
+			// The check can be skipped for currencies which ePay adds later on
+			p = NewTestPaymentRequest(WithPage(tt.page), WithCurrency(tt.currency), WithoutPageCurrencyCheck())
+			if err := p.Validate(); err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p := NewTestPaymentRequest()
+	if err := p.Validate(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// All problems are reported at once
+	p.cin = ""
+	p.Invoice = 0
+	p.Amount = 0
+	p.ExpirationTime = time.Time{}
+
+	err := p.Validate()
+	if err == nil {
+		t.Fatal("expected to fail, but got no error")
+	}
+
+	for _, expected := range []error{ErrEmptyCIN, ErrInvalidInvoice, ErrInvalidAmount, ErrInvalidExpiration} {
+		if !errors.Is(err, expected) {
+			t.Fatalf("expected error to match %q, but got %v", expected, err)
+		}
+	}
+
+	// encode validates as well
+	if err := p.encode(); !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("expected encode to fail with %q, but got %v", ErrInvalidAmount, err)
+	}
+
+	// The limits are reported with the sentinel errors
+	p = NewTestPaymentRequest()
+	p.Invoice = 10000000000
+	p.ExpirationTime = time.Now().AddDate(1, 0, 0)
+	err = p.Validate()
+	if !errors.Is(err, ErrInvalidInvoice) || !errors.Is(err, ErrInvalidExpiration) {
+		t.Fatalf("expected invoice and expiration errors, but got %v", err)
+	}
+	if errors.Is(err, ErrEmptyCIN) || errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("expected only invoice and expiration errors, but got %v", err)
+	}
+
+	// An expiration time which has passed is invalid as well
+	p = NewTestPaymentRequest()
+	p.ExpirationTime = time.Now().Add(-time.Minute)
+	if err := p.Validate(); !errors.Is(err, ErrInvalidExpiration) || !strings.Contains(err.Error(), "passed") {
+		t.Fatalf("expected an expiration error, but got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Package epayotel provides OpenTelemetry tracing for the epay package
+// It's a separate package, so the epay package itself doesn't depend on OpenTelemetry
+package epayotel
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	epay "github.com/arjanvaneersel/epay-go"
+)
+
+// instrumentationName is the name of the tracer of the package
+const instrumentationName = "github.com/arjanvaneersel/epay-go/epayotel"
+
+// Tracer creates spans for the operations of an epay.API
+type Tracer struct {
+	api    *epay.API
+	tracer trace.Tracer
+}
+
+// New returns a Tracer for api which creates its spans with a tracer of tp
+func New(api *epay.API, tp trace.TracerProvider) *Tracer {
+	return &Tracer{api: api, tracer: tp.Tracer(instrumentationName)}
+}
+
+// NewPaymentRequest works like epay.API.NewPaymentRequest within a span carrying the invoice
+func (t *Tracer) NewPaymentRequest(ctx context.Context, amount float64, description string, invoice uint64, options ...epay.PaymentOption) (*epay.PaymentRequest, error) {
+	_, span := t.tracer.Start(ctx, "epay.NewPaymentRequest", trace.WithAttributes(attribute.Int64("epay.invoice", int64(invoice))))
+	defer span.End()
+
+	p, err := t.api.NewPaymentRequest(amount, description, invoice, options...)
+	recordError(span, err)
+	return p, err
+}
+
+// CalcChecksum works like epay.PaymentRequest.CalcChecksum within a span carrying the invoice
+func (t *Tracer) CalcChecksum(ctx context.Context, p *epay.PaymentRequest, secret string) error {
+	_, span := t.tracer.Start(ctx, "epay.CalcChecksum", trace.WithAttributes(attribute.Int64("epay.invoice", int64(p.Invoice))))
+	defer span.End()
+
+	err := p.CalcChecksum(secret)
+	recordError(span, err)
+	return err
+}
+
+// PaymentRequestHandler wraps epay.API.PaymentRequestHandler with a span carrying the HTTP status of the response
+func (t *Tracer) PaymentRequestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := t.tracer.Start(r.Context(), "epay.PaymentRequestHandler", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	t.api.PaymentRequestHandler(sw, r.WithContext(ctx))
+	endHTTP(span, sw.status)
+}
+
+// PaymentCallbackHandler wraps epay.API.PaymentCallbackHandler with a span carrying the HTTP status of the response
+// Every payment in the callback gets a child span carrying its invoice, status and the answer to ePay, including payments
+// which are rejected before f is called. The context of the span is passed on to f.
+func (t *Tracer) PaymentCallbackHandler(f epay.PaymentHandlerFunc) http.HandlerFunc {
+	h := t.api.PaymentCallbackHandlerWithInterceptor(f, func(ctx context.Context, process func(context.Context) epay.CallbackResult) epay.CallbackResult {
+		ctx, span := t.tracer.Start(ctx, "epay.Payment")
+		defer span.End()
+
+		// The answer is the one the API sends to ePay
+		res := process(ctx)
+		span.SetAttributes(
+			attribute.Int64("epay.invoice", int64(res.Invoice)),
+			attribute.String("epay.status", string(res.Payment.Status)),
+			attribute.String("epay.answer", res.Status),
+		)
+		if res.Status == "ERR" {
+			recordError(span, res.Err)
+		}
+		return res
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := t.tracer.Start(r.Context(), "epay.PaymentCallbackHandler", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(ctx))
+		endHTTP(span, sw.status)
+	}
+}
+
+// recordError marks span as failed with err, if any
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// endHTTP sets the HTTP status of the response on span, server errors mark it as failed
+func endHTTP(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// statusWriter records the HTTP status written to the ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,200 @@
+package epayotel
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	epay "github.com/arjanvaneersel/epay-go"
+)
+
+// newCallbackRequest creates a signed ePay callback request carrying data
+func newCallbackRequest(secret, data string) *http.Request {
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(encoded))
+
+	form := url.Values{}
+	form.Set("encoded", encoded)
+	form.Set("checksum", hex.EncodeToString(h.Sum(nil)))
+
+	r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// newTracer returns a Tracer for a test API created with options and the exporter receiving its spans
+func newTracer(t *testing.T, options ...epay.Option) (*Tracer, *tracetest.InMemoryExporter) {
+	t.Helper()
+	api, err := epay.New("cin", "test", options...)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	return New(api, tp), exp
+}
+
+// attr returns the value of the attribute key of span
+func attr(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestNewPaymentRequest(t *testing.T) {
+	tr, exp := newTracer(t)
+
+	p, err := tr.NewPaymentRequest(context.Background(), 10, "test", 123)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := tr.CalcChecksum(context.Background(), p, "test"); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, but got %d", len(spans))
+	}
+
+	for i, name := range []string{"epay.NewPaymentRequest", "epay.CalcChecksum"} {
+		if spans[i].Name != name {
+			t.Fatalf("expected span %d to be %q, but got %q", i, name, spans[i].Name)
+		}
+		if got := attr(spans[i], "epay.invoice").AsInt64(); got != 123 {
+			t.Fatalf("expected invoice 123 on %q, but got %d", name, got)
+		}
+	}
+}
+
+func TestPaymentRequestHandler(t *testing.T) {
+	tr, exp := newTracer(t)
+
+	w := httptest.NewRecorder()
+	tr.PaymentRequestHandler(w, httptest.NewRequest(http.MethodGet, "/pay?amount=10&description=test&invoice=1", nil))
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "epay.PaymentRequestHandler" {
+		t.Fatalf("expected a span for the handler, but got %v", spans)
+	}
+	if got := attr(spans[0], "http.response.status_code").AsInt64(); got != int64(w.Code) {
+		t.Fatalf("expected status %d on the span, but got %d", w.Code, got)
+	}
+}
+
+func TestPaymentCallbackHandler(t *testing.T) {
+	tr, exp := newTracer(t)
+
+	h := tr.PaymentCallbackHandler(func(ctx context.Context, p epay.Payment) error {
+		if p.Invoice == 2 {
+			return epay.ErrInvalidInvoice
+		}
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID\nINVOICE=2:STATUS=DENIED"))
+	if expected := "INVOICE=1:STATUS=OK\nINVOICE=2:STATUS=NO\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	// The spans of the payments end before the span of the request
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, but got %d", len(spans))
+	}
+
+	parent := spans[2]
+	if parent.Name != "epay.PaymentCallbackHandler" {
+		t.Fatalf("expected the last span to be the handler, but got %q", parent.Name)
+	}
+
+	tests := []struct {
+		invoice int64
+		status  string
+		answer  string
+	}{
+		{1, "PAID", "OK"},
+		{2, "DENIED", "NO"},
+	}
+
+	for i, tt := range tests {
+		s := spans[i]
+		if s.Parent.SpanID() != parent.SpanContext.SpanID() {
+			t.Fatalf("expected the span of invoice %d to be a child of the handler", tt.invoice)
+		}
+		if got := attr(s, "epay.invoice").AsInt64(); got != tt.invoice {
+			t.Fatalf("expected invoice %d, but got %d", tt.invoice, got)
+		}
+		if got := attr(s, "epay.status").AsString(); got != tt.status {
+			t.Fatalf("expected status %q, but got %q", tt.status, got)
+		}
+		if got := attr(s, "epay.answer").AsString(); got != tt.answer {
+			t.Fatalf("expected answer %q, but got %q", tt.answer, got)
+		}
+	}
+}
+
+func TestPaymentCallbackHandlerAnswers(t *testing.T) {
+	// Invoice 3 is rejected before the PaymentHandlerFunc is called
+	tr, exp := newTracer(t, epay.WithStatusTransitionValidator(func(invoice uint64, status epay.PaymentStatus) error {
+		if invoice == 3 {
+			return fmt.Errorf("invoice %d is expired", invoice)
+		}
+		return nil
+	}))
+
+	h := tr.PaymentCallbackHandler(func(ctx context.Context, p epay.Payment) error {
+		switch p.Invoice {
+		case 1:
+			return fmt.Errorf("invoice %d: %w", p.Invoice, epay.ErrInvalidInvoice)
+		case 2:
+			return fmt.Errorf("database unavailable")
+		case 3:
+			t.Fatal("expected the rejected payment not to be handled")
+		}
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID\nINVOICE=2:STATUS=PAID\nINVOICE=3:STATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=NO\nINVOICE=2:STATUS=ERR\nINVOICE=3:STATUS=NO\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	// The spans carry the answers sent to ePay
+	spans := exp.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, but got %d", len(spans))
+	}
+
+	for i, answer := range []string{"NO", "ERR", "NO"} {
+		if got := attr(spans[i], "epay.invoice").AsInt64(); got != int64(i+1) {
+			t.Fatalf("expected invoice %d, but got %d", i+1, got)
+		}
+		if got := attr(spans[i], "epay.status").AsString(); got != "PAID" {
+			t.Fatalf("expected status PAID for invoice %d, but got %q", i+1, got)
+		}
+		if got := attr(spans[i], "epay.answer").AsString(); got != answer {
+			t.Fatalf("expected answer %q for invoice %d, but got %q", answer, i+1, got)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package epayprom provides Prometheus metrics for the epay package
+// It's a separate package, so the epay package itself doesn't depend on Prometheus
+package epayprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	epay "github.com/arjanvaneersel/epay-go"
+)
+
+// Metrics implements epay.Metrics with Prometheus counters and histograms
+type Metrics struct {
+	callbacks        *prometheus.CounterVec
+	callbackDuration prometheus.Histogram
+	invoices         *prometheus.CounterVec
+	outbound         *prometheus.CounterVec
+	outboundDuration prometheus.Histogram
+}
+
+// Ensure Metrics implements epay.Metrics
+var _ epay.Metrics = (*Metrics)(nil)
+
+// RegisterMetrics creates the ePay metrics and registers them with reg
+// The returned Metrics are to be passed to epay.New via epay.WithMetrics
+func RegisterMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		callbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "epay",
+			Name:      "callbacks_total",
+			Help:      "Number of ePay callbacks by result, which is answered or rejected.",
+		}, []string{"result"}),
+		callbackDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "epay",
+			Name:      "callback_duration_seconds",
+			Help:      "Duration of the processing of ePay callbacks.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		invoices: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "epay",
+			Name:      "callback_invoices_total",
+			Help:      "Number of invoices of answered ePay callbacks by answered status.",
+		}, []string{"status"}),
+		outbound: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "epay",
+			Name:      "outbound_requests_total",
+			Help:      "Number of requests to ePay by result.",
+		}, []string{"result"}),
+		outboundDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "epay",
+			Name:      "outbound_request_duration_seconds",
+			Help:      "Duration of requests to ePay.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.callbacks, m.callbackDuration, m.invoices, m.outbound, m.outboundDuration} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// CallbackProcessed implements epay.Metrics
+func (m *Metrics) CallbackProcessed(statuses []string, d time.Duration) {
+	result := "answered"
+	if len(statuses) == 0 {
+		result = "rejected"
+	}
+
+	m.callbacks.WithLabelValues(result).Inc()
+	m.callbackDuration.Observe(d.Seconds())
+	for _, status := range statuses {
+		m.invoices.WithLabelValues(status).Inc()
+	}
+}
+
+// OutboundRequest implements epay.Metrics
+func (m *Metrics) OutboundRequest(d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.outbound.WithLabelValues(result).Inc()
+	m.outboundDuration.Observe(d.Seconds())
+}
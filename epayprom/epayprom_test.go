@@ -0,0 +1,96 @@
+package epayprom
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	epay "github.com/arjanvaneersel/epay-go"
+)
+
+// newCallbackRequest creates a signed ePay callback request carrying data
+func newCallbackRequest(secret, data string) *http.Request {
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(encoded))
+
+	form := url.Values{}
+	form.Set("encoded", encoded)
+	form.Set("checksum", hex.EncodeToString(h.Sum(nil)))
+
+	r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := RegisterMetrics(reg)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if _, err := RegisterMetrics(reg); err == nil {
+		t.Fatal("expected an error when registering twice, but got nil")
+	}
+
+	api, err := epay.New("cin", "test", epay.WithMetrics(m))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p epay.Payment) error { return nil })
+	h(httptest.NewRecorder(), newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID"))
+	h(httptest.NewRecorder(), newCallbackRequest("test", "INVOICE=2:STATUS=PAID\nINVOICE=3:STATUS=PAID\nINVOICE=4:STATUS=UNKNOWN"))
+	h(httptest.NewRecorder(), newCallbackRequest("wrong", "INVOICE=5\nSTATUS=PAID"))
+
+	// Callbacks are counted and timed once, regardless of the number of their invoices
+	if got := testutil.ToFloat64(m.callbacks.WithLabelValues("answered")); got != 2 {
+		t.Fatalf("expected 2 answered callbacks, but got %v", got)
+	}
+
+	if got := testutil.ToFloat64(m.callbacks.WithLabelValues("rejected")); got != 1 {
+		t.Fatalf("expected 1 rejected callback, but got %v", got)
+	}
+
+	var duration dto.Metric
+	if err := m.callbackDuration.(prometheus.Metric).Write(&duration); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if got := duration.GetHistogram().GetSampleCount(); got != 3 {
+		t.Fatalf("expected 3 callback durations, but got %v", got)
+	}
+
+	// The invoices are counted by the status answered for them
+	if got := testutil.ToFloat64(m.invoices.WithLabelValues("OK")); got != 3 {
+		t.Fatalf("expected 3 OK invoices, but got %v", got)
+	}
+
+	if got := testutil.ToFloat64(m.invoices.WithLabelValues("ERR")); got != 1 {
+		t.Fatalf("expected 1 ERR invoice, but got %v", got)
+	}
+
+	m.OutboundRequest(time.Millisecond, nil)
+	m.OutboundRequest(time.Millisecond, errors.New("timeout"))
+
+	if got := testutil.ToFloat64(m.outbound.WithLabelValues("ok")); got != 1 {
+		t.Fatalf("expected 1 successful outbound request, but got %v", got)
+	}
+
+	if got := testutil.ToFloat64(m.outbound.WithLabelValues("error")); got != 1 {
+		t.Fatalf("expected 1 failed outbound request, but got %v", got)
+	}
+}
@@ -0,0 +1,30 @@
+package epay
+
+import "math"
+
+// roundCents rounds an amount to whole cents
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// CalculateWithFee calculates the total amount to request from the client when a fee is charged on top of amount
+// The fee consists of a percentage of amount (feePercent) and a fixed part (feeFixed). The total is rounded to cents.
+func CalculateWithFee(amount, feePercent, feeFixed float64) float64 {
+	return roundCents(amount + amount*feePercent/100 + feeFixed)
+}
+
+// SplitAmountFee inverts CalculateWithFee, so the base amount and fee can be shown separately given a total
+// Both base and fee are rounded to cents and always add up to total
+func SplitAmountFee(total, feePercent, feeFixed float64) (base, fee float64) {
+	base = roundCents((total - feeFixed) / (1 + feePercent/100))
+
+	// Due to rounding the calculated base can be a cent off, so check the neighbours in case it doesn't add up
+	for _, b := range []float64{base, base - 0.01, base + 0.01} {
+		if CalculateWithFee(roundCents(b), feePercent, feeFixed) == roundCents(total) {
+			base = roundCents(b)
+			break
+		}
+	}
+
+	return base, roundCents(total - base)
+}
@@ -0,0 +1,38 @@
+package epay
+
+import (
+	"testing"
+)
+
+func TestSplitAmountFee(t *testing.T) {
+	tests := []struct {
+		amount     float64
+		feePercent float64
+		feeFixed   float64
+	}{
+		{19.99, 2.5, 0.30},
+		{100, 0, 0},
+		{0.07, 1.9, 0.25},
+		{1234.56, 3.4, 0},
+		{49.95, 0, 1.5},
+	}
+
+	for _, tt := range tests {
+		total := CalculateWithFee(tt.amount, tt.feePercent, tt.feeFixed)
+
+		base, fee := SplitAmountFee(total, tt.feePercent, tt.feeFixed)
+		if base != tt.amount {
+			t.Fatalf("expected base of %.2f to be %.2f, but got %.2f", total, tt.amount, base)
+		}
+
+		if expected := roundCents(total - tt.amount); fee != expected {
+			t.Fatalf("expected fee of %.2f to be %.2f, but got %.2f", total, expected, fee)
+		}
+	}
+}
+
+func TestCalculateWithFee(t *testing.T) {
+	if expected, got := 20.79, CalculateWithFee(19.99, 2.5, 0.30); got != expected {
+		t.Fatalf("expected total to be %.2f, but got %.2f", expected, got)
+	}
+}
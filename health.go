@@ -0,0 +1,154 @@
+package epay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pingCache caches the result of Ping for HealthHandler, so probes don't cause a request to ePay every time
+type pingCache struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+
+	// running is closed when the running ping is done, it's nil when no ping is running
+	running chan struct{}
+}
+
+// health is the JSON answer of HealthHandler
+type health struct {
+	Healthy bool   `json:"healthy"`
+	Config  string `json:"config"`
+	EPay    string `json:"epay,omitempty"`
+}
+
+// WithHealthPing makes HealthHandler report whether ePay is reachable, the result of Ping is cached for ttl
+func WithHealthPing(ttl time.Duration) Option {
+	return func(api *API) error {
+		if ttl <= 0 {
+			return fmt.Errorf("ping ttl must be positive")
+		}
+
+		api.pingTTL = ttl
+		return nil
+	}
+}
+
+// Ping checks if ePay is reachable
+// An error is returned if the request fails or ePay responds with a server error
+func (api *API) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, api.url, nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	res, err := api.httpClient().Do(req)
+	if err == nil && res.StatusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("ePay responded with status %d", res.StatusCode)
+	}
+	api.outboundRequest(start, err)
+	if res != nil {
+		res.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	return nil
+}
+
+// cachedPing returns the result of the last Ping, which is repeated when it's older than the ttl set by WithHealthPing
+// Only one ping runs at a time and the lock isn't held while it does, so probes get the previous result meanwhile. Only
+// probes which arrive before the first result wait for it. The ping isn't bound to the probe which started it, because
+// its result is shared, and context errors aren't cached, so the next probe pings again.
+func (api *API) cachedPing(ctx context.Context) error {
+	api.ping.mu.Lock()
+	fresh := !api.ping.at.IsZero() && api.now().Sub(api.ping.at) < api.pingTTL
+	if fresh || (api.ping.running != nil && !api.ping.at.IsZero()) {
+		err := api.ping.err
+		api.ping.mu.Unlock()
+		return err
+	}
+
+	// Wait for the first ping, which is already running
+	if running := api.ping.running; running != nil {
+		api.ping.mu.Unlock()
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// The ping may not have been cached, in which case this probe pings itself
+		return api.cachedPing(ctx)
+	}
+
+	running := make(chan struct{})
+	api.ping.running = running
+	api.ping.mu.Unlock()
+
+	pingCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defaultHTTPTimeout)
+	defer cancel()
+	err := api.Ping(pingCtx)
+
+	api.ping.mu.Lock()
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		api.ping.err = err
+		api.ping.at = api.now()
+	}
+	api.ping.running = nil
+	api.ping.mu.Unlock()
+	close(running)
+	return err
+}
+
+// validateConfig checks if the API is configured properly to communicate with ePay
+func (api *API) validateConfig() error {
+	if api.cin == "" {
+		return fmt.Errorf("CIN is empty")
+	}
+
+	if api.currentSecret() == "" {
+		return errEmptySecret
+	}
+
+	if api.url == "" {
+		return fmt.Errorf("URL is empty")
+	}
+	return nil
+}
+
+// HealthHandler returns a HandlerFunc for health and readiness probes, e.g. of Kubernetes
+// It answers with the status 200 and a JSON body if the configuration is valid and 503 if it isn't. When WithHealthPing is
+// used, the reachability of ePay is reported as well and an unreachable ePay results in 503.
+func (api *API) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := health{Healthy: true, Config: "ok"}
+		if err := api.validateConfig(); err != nil {
+			res.Healthy = false
+			res.Config = err.Error()
+		}
+
+		if api.pingTTL > 0 {
+			res.EPay = "reachable"
+			if err := api.cachedPing(r.Context()); err != nil {
+				res.Healthy = false
+				res.EPay = err.Error()
+			}
+		}
+
+		status := http.StatusOK
+		if !res.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,203 @@
+package epay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var pings int
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings++
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithHealthPing(time.Minute), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	api.url = srv.URL + "/"
+
+	check := func(expectedCode int) health {
+		w := httptest.NewRecorder()
+		api.HealthHandler()(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if w.Code != expectedCode {
+			t.Fatalf("expected status code to be %d, but got %d: %s", expectedCode, w.Code, w.Body.String())
+		}
+
+		var res health
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+		return res
+	}
+
+	res := check(http.StatusOK)
+	if !res.Healthy || res.Config != "ok" || res.EPay != "reachable" {
+		t.Fatalf("expected a healthy result, but got %+v", res)
+	}
+
+	// The ping is cached
+	check(http.StatusOK)
+	if expected := 1; pings != expected {
+		t.Fatalf("expected %d ping, but got %d", expected, pings)
+	}
+
+	// An unreachable ePay is reported after the cache expired
+	status = http.StatusBadGateway
+	now = now.Add(time.Minute)
+	if res := check(http.StatusServiceUnavailable); res.Healthy || res.EPay == "reachable" {
+		t.Fatalf("expected ePay to be unreachable, but got %+v", res)
+	}
+
+	// A misconfigured API is unhealthy
+	api, err = New("cin", "")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if res := check(http.StatusServiceUnavailable); res.Healthy || res.Config == "ok" || res.EPay != "" {
+		t.Fatalf("expected a misconfigured result, but got %+v", res)
+	}
+}
+
+func TestCachedPingConcurrent(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		pings   int
+		blocked = make(chan struct{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pings++
+		n := pings
+		mu.Unlock()
+
+		// The second ping hangs until the test releases it
+		if n == 2 {
+			<-blocked
+		}
+	}))
+	defer srv.Close()
+
+	var clockMu sync.Mutex
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithHealthPing(time.Minute), WithClock(func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	api.url = srv.URL + "/"
+
+	if err := api.cachedPing(context.Background()); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The cache expires and a ping hangs, probes arriving meanwhile get the previous result without waiting
+	clockMu.Lock()
+	now = now.Add(time.Minute)
+	clockMu.Unlock()
+
+	done := make(chan error)
+	go func() { done <- api.cachedPing(context.Background()) }()
+	for {
+		mu.Lock()
+		n := pings
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	probe := make(chan error)
+	go func() { probe <- api.cachedPing(context.Background()) }()
+	select {
+	case err := <-probe:
+		if err != nil {
+			t.Fatalf("expected the previous result, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the probe not to wait for the running ping")
+	}
+
+	close(blocked)
+	if err := <-done; err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := 2; pings != expected {
+		t.Fatalf("expected %d pings, but got %d", expected, pings)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestCachedPingContext(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		pings int
+	)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		pings++
+		n := pings
+		mu.Unlock()
+
+		// The ping mustn't be canceled along with the probe which started it
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+
+		// The first ping times out, which mustn't be cached
+		if n == 1 {
+			return nil, context.DeadlineExceeded
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithHealthPing(time.Minute), WithHTTPClient(client), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := api.cachedPing(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %q, but got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := api.cachedPing(ctx); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The successful ping is cached
+	if err := api.cachedPing(context.Background()); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := 2; pings != expected {
+		t.Fatalf("expected %d pings, but got %d", expected, pings)
+	}
+}
@@ -0,0 +1,77 @@
+package epay
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGenerateInvoice(t *testing.T) {
+	const n = 1000
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = make(map[uint64]bool, 4*n)
+	)
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var last uint64
+			for i := 0; i < n; i++ {
+				invoice := GenerateInvoice()
+				if invoice <= last {
+					t.Errorf("expected invoice %d to be greater than %d", invoice, last)
+				}
+				last = invoice
+
+				if invoice == 0 || invoice > maxInvoice {
+					t.Errorf("expected invoice %d to have 1 to %d digits", invoice, maxInvoiceDigits)
+				}
+
+				mu.Lock()
+				if seen[invoice] {
+					t.Errorf("expected unique invoices, but got %d twice", invoice)
+				}
+				seen[invoice] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInvoiceGenerator(t *testing.T) {
+	const n = 1000
+
+	// Generators of different instances never return the same number, even when they're used at the same time
+	seen := make(map[uint64]bool, invoiceInstances*n)
+	for instance := 0; instance < invoiceInstances; instance++ {
+		g, err := NewInvoiceGenerator(instance)
+		if err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+
+		for i := 0; i < n; i++ {
+			invoice := g.Next()
+			if got := int(invoice % invoiceInstances); got != instance {
+				t.Fatalf("expected invoice %d to end with instance %d, but got %d", invoice, instance, got)
+			}
+			if invoice > maxInvoice {
+				t.Fatalf("expected invoice %d to have at most %d digits", invoice, maxInvoiceDigits)
+			}
+			if seen[invoice] {
+				t.Fatalf("expected unique invoices, but got %d twice", invoice)
+			}
+			seen[invoice] = true
+		}
+	}
+
+	for _, instance := range []int{-1, invoiceInstances} {
+		if _, err := NewInvoiceGenerator(instance); err == nil {
+			t.Fatalf("expected to fail for instance %d, but got no error", instance)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package epay
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// keyIDField is the field of the encoded data which contains the ID of the key a payment request is signed with
+	keyIDField = "KEY_ID"
+
+	// keyIDHeader is the header which contains the ID of the key a callback is signed with
+	keyIDHeader = "X-Key-ID"
+
+	// keyIDFormField is the form field which contains the ID of the key a callback is signed with, if the header isn't set
+	keyIDFormField = "key_id"
+)
+
+// WithKeySet sets the secrets by their key ID, which allows to migrate to a new secret without rejecting data signed with the old one
+// Callbacks which are tagged with a key ID are verified with the secret of that key. Use WithKeyID to sign with one of the keys.
+func WithKeySet(keys map[string]string) Option {
+	return func(api *API) error {
+		if len(keys) == 0 {
+			return fmt.Errorf("key set is empty")
+		}
+
+		api.keys = make(map[string]Secret, len(keys))
+		for id, secret := range keys {
+			if id == "" || secret == "" {
+				return fmt.Errorf("key set contains an empty key ID or secret")
+			}
+			api.keys[id] = NewSecret(secret)
+		}
+		return nil
+	}
+}
+
+// WithKeyID signs all data with the secret of key id from the key set instead of the secret passed to New
+// Payment requests are tagged with the key ID in the KEY_ID field of the encoded data
+func WithKeyID(id string) Option {
+	return func(api *API) error {
+		if id == "" {
+			return fmt.Errorf("key ID is empty")
+		}
+
+		api.keyID = id
+		return nil
+	}
+}
+
+// useKeyID replaces the secret of the API by the secret of the key set with the key ID set via WithKeyID
+func (api *API) useKeyID() error {
+	if api.keyID == "" {
+		return nil
+	}
+
+	secret, ok := api.keys[api.keyID]
+	if !ok {
+		return fmt.Errorf("key ID %q isn't part of the key set", api.keyID)
+	}
+	api.secret = secret
+	return nil
+}
+
+// callbackSecret returns the secret to verify the callback r with
+// It's the secret of the key ID the callback is tagged with or the secret of the API for untagged callbacks
+func (api *API) callbackSecret(r *http.Request) (string, error) {
+	id := r.Header.Get(keyIDHeader)
+	if id == "" {
+		id = r.FormValue(keyIDFormField)
+	}
+	return api.keySecret(id)
+}
+
+// keySecret returns the secret of key id from the key set or the secret of the API if id is empty
+func (api *API) keySecret(id string) (string, error) {
+	if id == "" {
+		return api.currentSecret(), nil
+	}
+
+	api.mu.RLock()
+	secret, ok := api.keys[id]
+	api.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown key ID %q", id)
+	}
+	return secret.Expose(), nil
+}
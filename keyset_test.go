@@ -0,0 +1,73 @@
+package epay
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKeySet(t *testing.T) {
+	keys := map[string]string{"2023": "old", "2024": "new"}
+	api, err := New("cin", "unused", WithKeySet(keys), WithKeyID("2024"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Payment requests are signed with the secret of the key ID and tagged with it
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := Checksum("new", p.Encoded()); p.Checksum() != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, p.Checksum())
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if !strings.Contains(string(d), "KEY_ID=2024\n") {
+		t.Fatalf("expected the encoded data to contain the key ID, but got %q", d)
+	}
+
+	// Callbacks are verified with the secret of the key ID they're tagged with
+	tests := []struct {
+		name   string
+		secret string
+		keyID  string
+		code   int
+	}{
+		{"old key", "old", "2023", http.StatusOK},
+		{"new key", "new", "2024", http.StatusOK},
+		{"untagged", "new", "", http.StatusOK},
+		{"wrong key", "old", "2024", http.StatusBadRequest},
+		{"unknown key", "old", "2022", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCallbackRequest(tt.secret, "INVOICE=1\nSTATUS=PAID\n")
+			if tt.keyID != "" {
+				r.Header.Set("X-Key-ID", tt.keyID)
+			}
+
+			w := httptest.NewRecorder()
+			api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("expected status code to be %d, but got %d", tt.code, w.Code)
+			}
+		})
+	}
+
+	if _, err := New("cin", "test", WithKeySet(keys), WithKeyID("2022")); err == nil {
+		t.Fatal("expected to fail for a key ID which isn't part of the key set, but got no error")
+	}
+}
@@ -0,0 +1,83 @@
+package epay
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bulgarianErrors are the Bulgarian messages of the sentinel errors returned by PaymentRequest.Validate
+var bulgarianErrors = map[error]string{
+	ErrEmptyCIN:            "Липсва КИН",
+	ErrInvalidInvoice:      "Невалиден номер на фактура",
+	ErrInvalidAmount:       "Невалидна сума",
+	ErrInvalidExpiration:   "Невалиден срок на валидност",
+	ErrUnsupportedCurrency: "Неподдържана валута",
+}
+
+// bulgarianMessages are the Bulgarian translations of the validation messages by their English format
+var bulgarianMessages = map[string]string{
+	"%w":                                   "%w",
+	"%w, must have at most %d digits":      "%w, трябва да има най-много %d цифри",
+	"Currency %q is invalid":               "Невалидна валута %q",
+	"%w, must be between %.2f and %.2f %s": "%w, трябва да бъде между %.2f и %.2f %s",
+	"%w, must be within %v from now":       "%w, трябва да бъде до %v от сега",
+	"Description is empty":                 "Липсва описание",
+	"Description is required for page %s":  "Описанието е задължително за страница %s",
+	"%w, %s is not supported by page %s":   "%w, %s не се поддържа от страница %s",
+}
+
+// localizedError is an error with a translated message, which still matches the English error via errors.Is and errors.As
+type localizedError struct {
+	msg string
+	err error
+}
+
+// Error implements error
+func (e *localizedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the English error
+func (e *localizedError) Unwrap() error {
+	return e.err
+}
+
+// WithErrorLanguage sets the language of the messages of the validation errors of payment requests
+// By default the messages are in English. The errors match the same sentinel errors in every language.
+func WithErrorLanguage(lang Language) Option {
+	return func(api *API) error {
+		if lang != English && lang != Bulgarian {
+			return fmt.Errorf("unsupported error language %q", lang)
+		}
+
+		api.errorLanguage = lang
+		return nil
+	}
+}
+
+// errorf returns the validation error described by format and a in the error language of the payment request
+// The format has to be in bulgarianMessages to be translated, the sentinel errors in a are replaced by their translations
+func (p *PaymentRequest) errorf(format string, a ...any) error {
+	err := fmt.Errorf(format, a...)
+	if p.errorLanguage != Bulgarian {
+		return err
+	}
+
+	bg, ok := bulgarianMessages[format]
+	if !ok {
+		return err
+	}
+
+	args := make([]any, len(a))
+	for i, v := range a {
+		if e, ok := v.(error); ok {
+			if msg, ok := bulgarianErrors[e]; ok {
+				v = msg
+			}
+		}
+		args[i] = v
+	}
+
+	// The English error is wrapped, so the translation only needs the message
+	return &localizedError{msg: fmt.Sprintf(strings.ReplaceAll(bg, "%w", "%v"), args...), err: err}
+}
@@ -0,0 +1,52 @@
+package epay
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWithErrorLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     Language
+		amount   float64
+		invoice  uint64
+		sentinel error
+		expected string
+	}{
+		{"bg amount", Bulgarian, 0, 1, ErrInvalidAmount, "Невалидна сума, трябва да бъде между 0.01 и"},
+		{"bg invoice", Bulgarian, 10, 0, ErrInvalidInvoice, "Невалиден номер на фактура"},
+		{"bg invoice digits", Bulgarian, 10, maxInvoice + 1, ErrInvalidInvoice, "Невалиден номер на фактура, трябва да има най-много 10 цифри"},
+		{"en amount", English, 0, 1, ErrInvalidAmount, "Amount is invalid, must be between 0.01 and"},
+		{"en invoice", English, 10, 0, ErrInvalidInvoice, "invalid invoice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := New("cin", "test", WithErrorLanguage(tt.lang))
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			p, err := api.NewPaymentRequest(tt.amount, "test", tt.invoice)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			err = p.Validate()
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected the message to contain %q, but got %q", tt.expected, err)
+			}
+
+			// The translated errors still match the sentinel errors
+			if !errors.Is(err, tt.sentinel) {
+				t.Fatalf("expected %v to match %v", err, tt.sentinel)
+			}
+		})
+	}
+
+	if _, err := New("cin", "test", WithErrorLanguage("de")); err == nil {
+		t.Fatal("expected to fail for an unsupported language, but got no error")
+	}
+}
@@ -0,0 +1,90 @@
+package epay
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseMoney parses an amount with its currency like "EUR 19.99" or "19.99 EUR"
+// The amount can't be negative and can't have more than two decimals
+func ParseMoney(s string) (float64, Currency, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid money %q, expected a currency and an amount", s)
+	}
+
+	// The currency can be before or after the amount
+	currency, amount := parts[0], parts[1]
+	if _, err := strconv.ParseFloat(currency, 64); err == nil {
+		currency, amount = amount, currency
+	}
+
+	curr, err := CurrencyFromString(currency)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid money %q: %v", s, err)
+	}
+
+	a, err := strconv.ParseFloat(amount, 64)
+	if err != nil || math.IsNaN(a) || math.IsInf(a, 0) || a < 0 {
+		return 0, "", fmt.Errorf("invalid money %q: invalid amount %q", s, amount)
+	}
+
+	if i := strings.IndexByte(amount, '.'); i >= 0 && len(amount)-i-1 > 2 {
+		return 0, "", fmt.Errorf("invalid money %q: amount has more than two decimals", s)
+	}
+
+	return a, curr, nil
+}
+
+// WithAmountCents sets the amount of the payment request in cents, which is sent to ePay exactly as given
+// It overrides the amount passed to NewPaymentRequest. If Amount is changed afterwards, the new Amount is used instead.
+func WithAmountCents(cents uint64) PaymentOption {
+	return func(p *PaymentRequest) error {
+		p.amountCents = cents
+		p.exactAmount = true
+		p.Amount = float64(cents) / 100
+		return nil
+	}
+}
+
+// cents returns the amount of the payment request in cents
+// The amount set via WithAmountCents is used as long as Amount hasn't been changed, otherwise Amount is rounded to cents.
+func (p *PaymentRequest) cents() int64 {
+	if p.exactAmount && float64(p.amountCents)/100 == p.Amount {
+		return int64(p.amountCents)
+	}
+	return int64(math.Round(p.Amount * 100))
+}
+
+// formatCents formats an amount in cents with two decimals, without rounding through floating point
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// parseAmount parses an amount echoed in a callback, which may be localized
+// Both "." and "," are accepted as decimal separator. If both occur, the last one is the decimal separator and the other
+// one separates thousands, like spaces do.
+func parseAmount(value string) (float64, error) {
+	v := strings.Join(strings.Fields(value), "")
+
+	dec := strings.LastIndexAny(v, ".,")
+	if dec >= 0 {
+		thousands := "."
+		if v[dec] == '.' {
+			thousands = ","
+		}
+		v = strings.ReplaceAll(v[:dec], thousands, "") + "." + v[dec+1:]
+	}
+
+	a, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(a) || math.IsInf(a, 0) {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return a, nil
+}
@@ -0,0 +1,175 @@
+package epay
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input    string
+		amount   float64
+		currency Currency
+		err      bool
+	}{
+		{"EUR 19.99", 19.99, EUR, false},
+		{"19.99 EUR", 19.99, EUR, false},
+		{"bgn 5", 5, BGN, false},
+		{"  USD   100.5 ", 100.5, USD, false},
+		{"EUR", 0, "", true},
+		{"19.99", 0, "", true},
+		{"EUR 19.99 extra", 0, "", true},
+		{"GBP 19.99", 0, "", true},
+		{"EUR abc", 0, "", true},
+		{"EUR -1", 0, "", true},
+		{"EUR NaN", 0, "", true},
+		{"EUR 1.999", 0, "", true},
+		{"", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			amount, currency, err := ParseMoney(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected to fail, but got %v %q", amount, currency)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			if amount != tt.amount || currency != tt.currency {
+				t.Fatalf("expected %v %q, but got %v %q", tt.amount, tt.currency, amount, currency)
+			}
+		})
+	}
+}
+
+func TestAmountSerialization(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		amount   float64
+		options  []PaymentOption
+		expected string
+	}{
+		{"0.07", 0.07, nil, "AMOUNT=0.07"},
+		{"19.99", 19.99, nil, "AMOUNT=19.99"},
+		{"1000000.01", 1000000.01, nil, "AMOUNT=1000000.01"},
+		{"cents 0.07", 0, []PaymentOption{WithAmountCents(7)}, "AMOUNT=0.07"},
+		{"cents 19.99", 0, []PaymentOption{WithAmountCents(1999)}, "AMOUNT=19.99"},
+		{"cents 1000000.01", 0, []PaymentOption{WithCurrency(BGN), WithAmountCents(1000000_01)}, "AMOUNT=1000000.01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := api.NewPaymentRequest(tt.amount, "test", 1, tt.options...)
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			n, err := p.EncodedLength()
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+
+			p.mu.RLock()
+			encoded, _ := p.encodeData()
+			p.mu.RUnlock()
+			d, _ := base64.StdEncoding.DecodeString(encoded)
+			if len(encoded) != n || !strings.Contains(string(d), "\n"+tt.expected+"\n") {
+				t.Fatalf("expected %q in the encoded data, but got %q", tt.expected, d)
+			}
+		})
+	}
+}
+
+func TestWithAmountCentsChangedAmount(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(0, "test", 1, WithAmountCents(1999))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Changing Amount afterwards takes precedence over the cents
+	p.Amount = 5.5
+	if expected := int64(550); p.cents() != expected {
+		t.Fatalf("expected %d cents, but got %d", expected, p.cents())
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+		err      bool
+	}{
+		{"19.99", 19.99, false},
+		{"19,99", 19.99, false},
+		{"1000", 1000, false},
+		{"1,234.56", 1234.56, false},
+		{"1.234,56", 1234.56, false},
+		{"1 234,56", 1234.56, false},
+		{" 0,07 ", 0.07, false},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"1,2,3.4.5", 0, true},
+		{"NaN", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseAmount(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, but got %v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected to pass, but got %v", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected %v, but got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCallbackAmount(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, amount := range []string{"19.99", "19,99"} {
+		payments, err := api.ParseCallback(callbackData(t, "INVOICE=1:STATUS=PAID:AMOUNT="+amount))
+		if err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+
+		if expected := 19.99; payments[0].Amount != expected {
+			t.Fatalf("expected amount %q to be %v, but got %v", amount, expected, payments[0].Amount)
+		}
+	}
+}
+
+// callbackData returns the encoded data and checksum of a callback carrying data, signed with the secret "test"
+func callbackData(t *testing.T, data string) (string, string) {
+	t.Helper()
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+	return encoded, Checksum("test", encoded)
+}
@@ -0,0 +1,84 @@
+package epay
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config contains the configuration of an API which can be changed at runtime with Reload
+type Config struct {
+	// Secret is the secret used to sign and verify data
+	Secret string
+
+	// URLOk is the default URL to which the customer is redirected after a successful payment
+	URLOk string
+
+	// URLCancel is the default URL to which the customer is redirected after a cancelled payment
+	URLCancel string
+
+	// Timeout is the timeout of requests to ePay, zero keeps the current timeout, e.g. of a client set via WithHTTPClient
+	Timeout time.Duration
+}
+
+// Reload replaces the configuration of the API with cfg, e.g. after rotating the secret
+// The configuration is swapped at once, requests which are in progress continue with the values they started with.
+// When a key ID is set via WithKeyID, the secret of that key ID is replaced as well, so payment requests tagged with it
+// keep matching the secret they're signed with. Nothing is changed if cfg is invalid.
+func (api *API) Reload(cfg Config) error {
+	if cfg.Secret == "" {
+		return errEmptySecret
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("timeout can't be negative")
+	}
+
+	urlOk, urlCancel := cfg.URLOk, cfg.URLCancel
+	if urlOk != "" {
+		v, err := validateURL(urlOk)
+		if err != nil {
+			return err
+		}
+		urlOk = v
+	}
+	if urlCancel != "" {
+		v, err := validateURL(urlCancel)
+		if err != nil {
+			return err
+		}
+		urlCancel = v
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	// Copy the client instead of changing it, because it might be in use
+	if cfg.Timeout > 0 {
+		client := *defaultHTTPClient
+		if api.client != nil {
+			client = *api.client
+		}
+		client.Timeout = cfg.Timeout
+		api.client = &client
+	}
+
+	api.secret = NewSecret(cfg.Secret)
+	if api.keyID != "" {
+		// Copy the key set instead of changing it, because it might be in use
+		keys := make(map[string]Secret, len(api.keys))
+		for id, secret := range api.keys {
+			keys[id] = secret
+		}
+		keys[api.keyID] = api.secret
+		api.keys = keys
+	}
+	api.urlOk = urlOk
+	api.urlCancel = urlCancel
+	return nil
+}
+
+// currentSecret returns the secret of the API
+func (api *API) currentSecret() string {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.secret.Expose()
+}
@@ -0,0 +1,183 @@
+package epay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	api, err := New("cin", "old", WithDefaultURLOk("https://example.com/ok"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	cfg := Config{
+		Secret:    "new",
+		URLOk:     "https://example.com/paid",
+		URLCancel: "https://example.com/cancelled",
+		Timeout:   5 * time.Second,
+	}
+	if err := api.Reload(cfg); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	f := func(ctx context.Context, p Payment) error { return nil }
+	data := "INVOICE=1\nSTATUS=PAID\n"
+
+	w := httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("new", data))
+	if expected := "INVOICE=1:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	api.PaymentCallbackHandler(f)(w, newCallbackRequest("old", data))
+	if expected := http.StatusBadRequest; w.Code != expected {
+		t.Fatalf("expected status code for the old secret to be %d, but got %d", expected, w.Code)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if p.URLOk != cfg.URLOk || p.URLCancel != cfg.URLCancel {
+		t.Fatalf("expected the reloaded URLs, but got %q and %q", p.URLOk, p.URLCancel)
+	}
+
+	if expected := cfg.Timeout; api.httpClient().Timeout != expected {
+		t.Fatalf("expected timeout to be %v, but got %v", expected, api.httpClient().Timeout)
+	}
+
+	// An invalid configuration mustn't change anything
+	if err := api.Reload(Config{Secret: "other", URLOk: "ftp://example.com"}); err == nil {
+		t.Fatal("expected to fail for an invalid URL, but got no error")
+	}
+	if err := api.Reload(Config{}); err == nil {
+		t.Fatal("expected to fail for an empty secret, but got no error")
+	}
+	if expected := api.Sign(data); expected != Checksum("new", data) {
+		t.Fatal("expected the secret not to change after a failed reload")
+	}
+}
+
+func TestReloadHTTPClient(t *testing.T) {
+	client := &http.Client{Timeout: time.Minute}
+	api, err := New("cin", "old", WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Without a timeout the injected client is kept
+	if err := api.Reload(Config{Secret: "new"}); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if api.httpClient() != client {
+		t.Fatal("expected the injected client to be kept")
+	}
+
+	// With a timeout a copy of the injected client is used, which keeps its transport
+	client.Transport = &http.Transport{}
+	if err := api.Reload(Config{Secret: "new", Timeout: 5 * time.Second}); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if expected := 5 * time.Second; api.httpClient().Timeout != expected {
+		t.Fatalf("expected timeout to be %v, but got %v", expected, api.httpClient().Timeout)
+	}
+	if api.httpClient().Transport != client.Transport {
+		t.Fatal("expected the transport of the injected client to be kept")
+	}
+	if expected := time.Minute; client.Timeout != expected {
+		t.Fatalf("expected the injected client not to change, but got a timeout of %v", client.Timeout)
+	}
+
+	if err := api.Reload(Config{Secret: "new", Timeout: -time.Second}); err == nil {
+		t.Fatal("expected to fail for a negative timeout, but got no error")
+	}
+}
+
+func TestReloadWithKeyID(t *testing.T) {
+	api, err := New("cin", "unused", WithKeySet(map[string]string{"2023": "old", "2024": "new"}), WithKeyID("2024"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := api.Reload(Config{Secret: "newer"}); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Payment requests are still tagged with the key ID, which now stands for the reloaded secret
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if expected := Checksum("newer", p.Encoded()); p.Checksum() != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, p.Checksum())
+	}
+
+	// Callbacks tagged with the key ID are verified with the reloaded secret, the other keys are kept
+	tests := []struct {
+		secret string
+		keyID  string
+		code   int
+	}{
+		{"newer", "2024", http.StatusOK},
+		{"new", "2024", http.StatusBadRequest},
+		{"old", "2023", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := newCallbackRequest(tt.secret, "INVOICE=1\nSTATUS=PAID\n")
+		r.Header.Set("X-Key-ID", tt.keyID)
+
+		w := httptest.NewRecorder()
+		api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })(w, r)
+		if w.Code != tt.code {
+			t.Fatalf("expected status code for secret %q and key ID %s to be %d, but got %d", tt.secret, tt.keyID, tt.code, w.Code)
+		}
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error { return nil })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				h(w, newCallbackRequest("test", "INVOICE=1\nSTATUS=PAID\n"))
+				if expected := "INVOICE=1:STATUS=OK\n"; w.Body.String() != expected {
+					t.Errorf("expected answer to be %q, but got %q", expected, w.Body.String())
+					return
+				}
+
+				if _, err := api.NewPaymentRequest(10, "test", 1); err != nil {
+					t.Errorf("expected to pass, but got %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		cfg := Config{Secret: "test", URLOk: "https://example.com/ok", Timeout: time.Duration(i) * time.Second}
+		if err := api.Reload(cfg); err != nil {
+			t.Fatalf("expected to pass, but got %v", err)
+		}
+	}
+	wg.Wait()
+}
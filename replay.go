@@ -0,0 +1,64 @@
+package epay
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// replayCache remembers the answers to recently processed callbacks by the hash of their encoded data
+type replayCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[[sha256.Size]byte]replayEntry
+}
+
+// replayEntry is the answer to a processed callback
+type replayEntry struct {
+	at      time.Time
+	results CallbackResults
+}
+
+// WithReplayProtection detects callbacks which are replayed within window by hashing their encoded data
+// Replayed callbacks aren't passed to the PaymentHandlerFunc again, they're answered with the answer to the original
+// callback instead. Only final answers are remembered, so callbacks answered with ERR are still retried.
+func WithReplayProtection(window time.Duration) Option {
+	return func(api *API) error {
+		if window <= 0 {
+			return fmt.Errorf("replay window must be positive")
+		}
+
+		api.replay = &replayCache{window: window, entries: map[[sha256.Size]byte]replayEntry{}}
+		return nil
+	}
+}
+
+// get returns the answer to the callback with the encoded data if it has been processed within the window before now
+func (c *replayCache) get(encoded string, now time.Time) (CallbackResults, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Forget the callbacks which are outside of the window
+	for key, e := range c.entries {
+		if now.Sub(e.at) >= c.window {
+			delete(c.entries, key)
+		}
+	}
+
+	e, ok := c.entries[sha256.Sum256([]byte(encoded))]
+	return e.results, ok
+}
+
+// put remembers the answer to the callback with the encoded data, unless any of the results is an ERR
+func (c *replayCache) put(encoded string, now time.Time, results CallbackResults) {
+	for _, res := range results {
+		if res.Status == "ERR" {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[sha256.Sum256([]byte(encoded))] = replayEntry{at: now, results: results}
+}
@@ -0,0 +1,78 @@
+package epay
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithReplayProtection(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	api, err := New("cin", "test", WithReplayProtection(time.Hour), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	var calls int
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		calls++
+		return nil
+	})
+
+	data := "INVOICE=1:STATUS=PAID"
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h(w, newCallbackRequest("test", data))
+		if expected := "INVOICE=1:STATUS=OK\n"; w.Body.String() != expected {
+			t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+		}
+	}
+
+	// The replay is answered without calling the handler again
+	if expected := 1; calls != expected {
+		t.Fatalf("expected the handler to be called %d time, but got %d", expected, calls)
+	}
+
+	// A different payload isn't a replay
+	h(httptest.NewRecorder(), newCallbackRequest("test", "INVOICE=2:STATUS=PAID"))
+	if expected := 2; calls != expected {
+		t.Fatalf("expected the handler to be called %d times, but got %d", expected, calls)
+	}
+
+	// The payload is processed again after the window
+	now = now.Add(time.Hour)
+	h(httptest.NewRecorder(), newCallbackRequest("test", data))
+	if expected := 3; calls != expected {
+		t.Fatalf("expected the handler to be called %d times, but got %d", expected, calls)
+	}
+
+	if _, err := New("cin", "test", WithReplayProtection(0)); err == nil {
+		t.Fatal("expected to fail for a zero window, but got no error")
+	}
+}
+
+func TestReplayProtectionRetriesErrors(t *testing.T) {
+	api, err := New("cin", "test", WithReplayProtection(time.Hour))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// Callbacks answered with ERR are retried by ePay, so they have to be processed again
+	var calls int
+	h := api.PaymentCallbackHandler(func(ctx context.Context, p Payment) error {
+		calls++
+		if calls == 1 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+
+	h(httptest.NewRecorder(), newCallbackRequest("test", "INVOICE=1:STATUS=PAID"))
+	w := httptest.NewRecorder()
+	h(w, newCallbackRequest("test", "INVOICE=1:STATUS=PAID"))
+	if expected := "INVOICE=1:STATUS=OK\n"; w.Body.String() != expected {
+		t.Fatalf("expected answer to be %q, but got %q", expected, w.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+package epay
+
+// redacted replaces a Secret when it's formatted
+const redacted = "[REDACTED]"
+
+// Secret holds a secret key, which is redacted when it's formatted, so it doesn't leak into logs via %v or %+v
+// The key is kept behind a pointer, because fmt prints unexported fields without calling their String method, but it
+// only prints the address of a nested pointer
+type Secret struct {
+	key *string
+}
+
+// NewSecret returns the Secret holding key
+func NewSecret(key string) Secret {
+	return Secret{key: &key}
+}
+
+// Expose returns the key, which is only to be used for signing and verifying
+func (s Secret) Expose() string {
+	if s.key == nil {
+		return ""
+	}
+	return *s.key
+}
+
+// String implements fmt.Stringer without revealing the key
+func (s Secret) String() string {
+	return redacted
+}
+
+// GoString implements fmt.GoStringer without revealing the key
+func (s Secret) GoString() string {
+	return redacted
+}
@@ -0,0 +1,36 @@
+package epay
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	api, err := New("cin", "supersecret", WithKeySet(map[string]string{"old": "oldsecret", "new": "newsecret"}), WithKeyID("new"))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s"} {
+		out := fmt.Sprintf(verb, api)
+		for _, secret := range []string{"supersecret", "oldsecret", "newsecret"} {
+			if strings.Contains(out, secret) {
+				t.Fatalf("expected %s not to reveal %q, but got %s", verb, secret, out)
+			}
+		}
+	}
+
+	s := NewSecret("supersecret")
+	if got := fmt.Sprintf("%v %+v %#v %s", s, s, s, s); strings.Contains(got, "supersecret") {
+		t.Fatalf("expected the secret to be redacted, but got %s", got)
+	}
+
+	if expected := "supersecret"; s.Expose() != expected {
+		t.Fatalf("expected the secret to be %q, but got %q", expected, s.Expose())
+	}
+
+	if expected := ""; (Secret{}).Expose() != expected {
+		t.Fatalf("expected the zero secret to be %q, but got %q", expected, (Secret{}).Expose())
+	}
+}
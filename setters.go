@@ -0,0 +1,80 @@
+package epay
+
+import "time"
+
+// invalidate clears the encoded data and checksum, so they're recalculated by the next call to CalcChecksum or Prepare
+// The caller has to hold the lock of p
+func (p *PaymentRequest) invalidate() {
+	p.encoded = ""
+	p.checksum = ""
+}
+
+// SetAmount sets the amount and invalidates the checksum
+// It returns p, so setters can be chained, e.g. p.SetAmount(10).SetCurrency(BGN)
+func (p *PaymentRequest) SetAmount(amount float64) *PaymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Amount = amount
+	p.invalidate()
+	return p
+}
+
+// SetCurrency sets the currency and invalidates the checksum
+func (p *PaymentRequest) SetCurrency(c Currency) *PaymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Currency = c
+	p.invalidate()
+	return p
+}
+
+// SetDescription sets the description and invalidates the checksum
+func (p *PaymentRequest) SetDescription(description string) *PaymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Description = description
+	p.invalidate()
+	return p
+}
+
+// SetInvoice sets the invoice number and invalidates the checksum
+func (p *PaymentRequest) SetInvoice(invoice uint64) *PaymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Invoice = invoice
+	p.invalidate()
+	return p
+}
+
+// SetExpirationTime sets the expiration time and invalidates the checksum
+func (p *PaymentRequest) SetExpirationTime(t time.Time) *PaymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ExpirationTime = t
+	p.invalidate()
+	return p
+}
+
+// SetLanguage sets the language and invalidates the checksum
+func (p *PaymentRequest) SetLanguage(l Language) *PaymentRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Language = l
+	p.invalidate()
+	return p
+}
+
+// Prepare encodes p and calculates its checksum with the secret of the API, after which p is ready to be sent to ePay
+// Params, GenerateForm, ButtonHTML and RedirectURL encode p themselves, but without the secret they can't calculate the
+// checksum, so they return an error until p is prepared.
+func (api *API) Prepare(p *PaymentRequest) error {
+	return p.CalcChecksum(api.currentSecret())
+}
+
+// IsPrepared returns true if p has been encoded and signed, e.g. to guard rendering a payment form
+// Changing p via one of the setters invalidates it until it's prepared again
+func (p *PaymentRequest) IsPrepared() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.encoded != "" && p.checksum != ""
+}
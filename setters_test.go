@@ -0,0 +1,88 @@
+package epay
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSetters(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	before := p.Checksum()
+
+	p.SetAmount(20).SetCurrency(BGN)
+	if p.Encoded() != "" || p.Checksum() != "" {
+		t.Fatal("expected the setters to invalidate the encoded data and checksum")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if p.Checksum() == before {
+		t.Fatal("expected the checksum to change")
+	}
+
+	if expected := api.Sign(p.Encoded()); p.Checksum() != expected {
+		t.Fatalf("expected checksum to be %q, but got %q", expected, p.Checksum())
+	}
+
+	d, err := base64.StdEncoding.DecodeString(p.Encoded())
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	for _, expected := range []string{"AMOUNT=20.00\n", "CURRENCY=BGN\n"} {
+		if !strings.Contains(string(d), expected) {
+			t.Fatalf("expected encoded data to contain %q, but got %q", expected, d)
+		}
+	}
+}
+
+func TestIsPrepared(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p, err := api.NewPaymentRequest(10, "test", 1)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if p.IsPrepared() {
+		t.Fatal("expected the payment request not to be prepared before Prepare")
+	}
+
+	// Encoding alone doesn't sign the payment request
+	if err := p.encode(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if p.IsPrepared() {
+		t.Fatal("expected the payment request not to be prepared without a checksum")
+	}
+
+	if err := api.Prepare(p); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	if !p.IsPrepared() {
+		t.Fatal("expected the payment request to be prepared after Prepare")
+	}
+
+	p.SetAmount(20)
+	if p.IsPrepared() {
+		t.Fatal("expected the payment request not to be prepared after a change")
+	}
+}
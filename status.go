@@ -0,0 +1,184 @@
+package epay
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// paymentCheckPath is the path of ePay's server-to-server interface for checking the status of a payment
+	paymentCheckPath = "v3main/check"
+
+	// queryWorkers is the number of concurrent requests done by QueryPaymentStatuses
+	queryWorkers = 4
+
+	// maxResponseSize is the maximum size of a response from ePay which is read
+	maxResponseSize = 1 << 20
+
+	// defaultHTTPTimeout is the timeout of requests to ePay, unless another client is set via WithHTTPClient
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// defaultHTTPClient is the HTTP client used for requests to ePay, unless another client is set via WithHTTPClient
+var defaultHTTPClient = &http.Client{Timeout: defaultHTTPTimeout}
+
+// ErrUnknownInvoice is returned by CheckPayment when ePay doesn't know the invoice
+var ErrUnknownInvoice = errors.New("unknown invoice")
+
+// httpClient returns the HTTP client used for requests to ePay
+func (api *API) httpClient() *http.Client {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	if api.client == nil {
+		return defaultHTTPClient
+	}
+	return api.client
+}
+
+// outboundRequest informs the metrics about a request to ePay, which started at start
+func (api *API) outboundRequest(start time.Time, err error) {
+	if api.metrics != nil {
+		api.metrics.OutboundRequest(time.Since(start), err)
+	}
+}
+
+// CheckPayment queries ePay for the status of the payment of invoice, e.g. for reconciliation when a callback got lost
+// The request contains the CIN and invoice as encoded data signed with the secret, the response is verified in the same way
+// ErrUnknownInvoice is returned if ePay doesn't know the invoice.
+func (api *API) CheckPayment(ctx context.Context, invoice uint64) (*Payment, error) {
+	// Prepare the signed request, the response is verified with the same secret
+	secret := api.currentSecret()
+	encoded := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("MIN=%s\nINVOICE=%d\n", api.cin, invoice)))
+	form := url.Values{}
+	form.Set("ENCODED", encoded)
+	form.Set("CHECKSUM", Checksum(secret, encoded))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.url+paymentCheckPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Execute the request
+	start := time.Now()
+	res, err := api.httpClient().Do(req)
+	api.outboundRequest(start, err)
+	if err != nil {
+		return nil, fmt.Errorf("check request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("check request failed with status %d", res.StatusCode)
+	}
+
+	// Read and verify the response
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read check response: %v", err)
+	}
+
+	values, err := url.ParseQuery(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid check response: %v", err)
+	}
+
+	if !VerifyChecksum(secret, values.Get("ENCODED"), values.Get("CHECKSUM")) {
+		return nil, fmt.Errorf("invalid checksum in check response")
+	}
+
+	d, err := base64.StdEncoding.DecodeString(values.Get("ENCODED"))
+	if err != nil {
+		return nil, fmt.Errorf("decoding error: %v", err)
+	}
+
+	// Parse the payload into a payment
+	// ePay answers with the status NO when the invoice is unknown, which isn't a valid status of a payment
+	payment, err := api.parsePayment(splitPayments(string(d))[0], false)
+	if payment.Status == "NO" {
+		return nil, ErrUnknownInvoice
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Invoice != invoice {
+		return nil, fmt.Errorf("check response is for invoice %d instead of %d", payment.Invoice, invoice)
+	}
+
+	return &payment, nil
+}
+
+// QueryPaymentStatuses queries ePay for the statuses of the payments of invoices, e.g. for reconciliation
+// ePay's interface checks a single invoice per request, so the invoices are queried concurrently by a pool of workers
+// Invoices unknown to ePay are left out of the result. The first error which occurs is returned, in which case the
+// remaining queries are cancelled.
+func (api *API) QueryPaymentStatuses(ctx context.Context, invoices []uint64) (map[uint64]Payment, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		payments = make(map[uint64]Payment, len(invoices))
+		jobs     = make(chan uint64)
+	)
+
+	workers := queryWorkers
+	if len(invoices) < workers {
+		workers = len(invoices)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for invoice := range jobs {
+				p, err := api.CheckPayment(ctx, invoice)
+
+				mu.Lock()
+				switch {
+				case err == ErrUnknownInvoice:
+					// Invoices unknown to ePay are left out
+				case err != nil:
+					if firstErr == nil {
+						firstErr = fmt.Errorf("invoice %d: %v", invoice, err)
+						cancel()
+					}
+				default:
+					payments[invoice] = *p
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Distribute the invoices over the workers
+	for _, invoice := range invoices {
+		select {
+		case jobs <- invoice:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
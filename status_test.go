@@ -0,0 +1,221 @@
+package epay
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkHandler is a mock of ePay's check interface which answers with the statuses in statuses
+// Invoices which aren't in statuses are answered as unknown
+func checkHandler(api *API, statuses map[uint64]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+paymentCheckPath {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !api.Verify(r.FormValue("ENCODED"), r.FormValue("CHECKSUM")) {
+			http.Error(w, "invalid checksum", http.StatusBadRequest)
+			return
+		}
+
+		d, err := base64.StdEncoding.DecodeString(r.FormValue("ENCODED"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var invoice uint64
+		for _, line := range strings.Split(string(d), "\n") {
+			if strings.HasPrefix(line, "INVOICE=") {
+				invoice, _ = strconv.ParseUint(strings.TrimPrefix(line, "INVOICE="), 10, 64)
+			}
+		}
+
+		status, ok := statuses[invoice]
+		if !ok {
+			status = "NO"
+		}
+
+		encoded := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("INVOICE=%d\nSTATUS=%s\nSTAN=%d", invoice, status, invoice*10)))
+		fmt.Fprint(w, url.Values{"ENCODED": {encoded}, "CHECKSUM": {api.Sign(encoded)}}.Encode())
+	})
+}
+
+func TestQueryPaymentStatuses(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	srv := httptest.NewServer(checkHandler(api, map[uint64]string{1: "PAID", 2: "DENIED", 4: "EXPIRED"}))
+	defer srv.Close()
+	api.url = srv.URL + "/"
+
+	payments, err := api.QueryPaymentStatuses(context.Background(), []uint64{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	expected := map[uint64]PaymentStatus{1: Paid, 2: Denied, 4: Expired}
+	if len(payments) != len(expected) {
+		t.Fatalf("expected %d payments, but got %d", len(expected), len(payments))
+	}
+
+	for invoice, status := range expected {
+		p, ok := payments[invoice]
+		if !ok {
+			t.Fatalf("expected a payment for invoice %d", invoice)
+		}
+
+		if p.Status != status || p.Stan != int64(invoice*10) {
+			t.Fatalf("expected invoice %d to have status %q and stan %d, but got %+v", invoice, status, invoice*10, p)
+		}
+	}
+
+	other, err := New("cin", "other")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	other.url = api.url
+
+	if _, err := other.QueryPaymentStatuses(context.Background(), []uint64{1}); err == nil {
+		t.Fatal("expected an error for a rejected request, but got nil")
+	}
+}
+
+func TestWithProxyURL(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// The proxy receives the requests for ePay and answers them itself
+	var hosts []string
+	check := checkHandler(api, map[uint64]string{1: "PAID"})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.URL.Host)
+		check.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	api, err = New("cin", "test", WithProxyURL(proxy.URL))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+	api.url = "http://epay.invalid/"
+
+	payments, err := api.QueryPaymentStatuses(context.Background(), []uint64{1})
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if payments[1].Status != Paid {
+		t.Fatalf("expected invoice 1 to be %q, but got %+v", Paid, payments[1])
+	}
+
+	if len(hosts) != 1 || hosts[0] != "epay.invalid" {
+		t.Fatalf("expected one proxied request for epay.invalid, but got %v", hosts)
+	}
+
+	if _, err := New("cin", "test", WithProxyURL("://invalid")); err == nil {
+		t.Fatal("expected an error for an invalid proxy URL, but got nil")
+	}
+}
+
+// recordingTransport records the requests and lets handler answer them
+type recordingTransport struct {
+	handler  http.Handler
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, r)
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if expected := 30 * time.Second; api.httpClient().Timeout != expected {
+		t.Fatalf("expected the default timeout to be %v, but got %v", expected, api.httpClient().Timeout)
+	}
+
+	transport := &recordingTransport{handler: checkHandler(api, map[uint64]string{1: "PAID"})}
+	api, err = New("cin", "test", WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	payments, err := api.QueryPaymentStatuses(context.Background(), []uint64{1})
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	if payments[1].Status != Paid {
+		t.Fatalf("expected invoice 1 to be %q, but got %+v", Paid, payments[1])
+	}
+
+	if expected := 1; len(transport.requests) != expected {
+		t.Fatalf("expected %d request via the client, but got %d", expected, len(transport.requests))
+	}
+
+	if expected := ePayURL + paymentCheckPath; transport.requests[0].URL.String() != expected {
+		t.Fatalf("expected request to %q, but got %q", expected, transport.requests[0].URL)
+	}
+
+	if _, err := New("cin", "test", WithHTTPClient(nil)); err == nil {
+		t.Fatal("expected to fail for a nil client, but got no error")
+	}
+}
+
+func TestCheckPayment(t *testing.T) {
+	api, err := New("cin", "test")
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	// ePay answers with a canned signed response
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/"+paymentCheckPath {
+			http.NotFound(w, r)
+			return
+		}
+
+		data := "INVOICE=42:STATUS=PAID:PAY_TIME=20240101120000:STAN=1234:BCODE=AB12"
+		if r.FormValue("ENCODED") != base64.StdEncoding.EncodeToString([]byte("MIN=cin\nINVOICE=42\n")) {
+			data = "INVOICE=0:STATUS=NO"
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte(data))
+		fmt.Fprint(w, url.Values{"ENCODED": {encoded}, "CHECKSUM": {api.Sign(encoded)}}.Encode())
+	}))
+	defer srv.Close()
+	api.url = srv.URL + "/"
+
+	p, err := api.CheckPayment(context.Background(), 42)
+	if err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	expected := Payment{Invoice: 42, Status: Paid, PayDate: time.Date(2024, 1, 1, 12, 0, 0, 0, sofia), Stan: 1234, Bcode: "AB12"}
+	if *p != expected {
+		t.Fatalf("expected payment to be %+v, but got %+v", expected, *p)
+	}
+
+	if _, err := api.CheckPayment(context.Background(), 43); err != ErrUnknownInvoice {
+		t.Fatalf("expected ErrUnknownInvoice, but got %v", err)
+	}
+}
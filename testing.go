@@ -0,0 +1,30 @@
+package epay
+
+import (
+	"fmt"
+	"time"
+)
+
+// NewTestPaymentRequest returns a valid payment request with placeholder values, which is meant for writing tests
+// The placeholder values can be changed by the provided options. NewTestPaymentRequest panics if any of the options fails.
+func NewTestPaymentRequest(opts ...PaymentOption) *PaymentRequest {
+	p := PaymentRequest{
+		page:           string(Direct),
+		cin:            "1000000000",
+		url:            ePayDemoURL,
+		ExpirationTime: time.Now().AddDate(0, 0, 7),
+		Language:       English,
+		Currency:       EUR,
+		Amount:         10,
+		Description:    "Test payment",
+		Invoice:        1,
+	}
+
+	for _, opt := range opts {
+		if err := opt(&p); err != nil {
+			panic(fmt.Sprintf("epay: test payment request option failed: %v", err))
+		}
+	}
+
+	return &p
+}
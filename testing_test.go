@@ -0,0 +1,24 @@
+package epay
+
+import (
+	"testing"
+)
+
+func TestNewTestPaymentRequest(t *testing.T) {
+	p := NewTestPaymentRequest()
+	if err := p.Validate(); err != nil {
+		t.Fatalf("expected to pass, but got %v", err)
+	}
+
+	p = NewTestPaymentRequest(WithCurrency(BGN))
+	if p.Currency != BGN {
+		t.Fatalf("expected currency to be %q, but got %q", BGN, p.Currency)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for a failing option")
+		}
+	}()
+	NewTestPaymentRequest(WithCharset("latin1"))
+}